@@ -0,0 +1,108 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package ifacestate
+
+import (
+	"github.com/snapcore/snapd/interfaces"
+	"github.com/snapcore/snapd/overlord/ifacestate/ifacerepo"
+	"github.com/snapcore/snapd/overlord/snapstate"
+	"github.com/snapcore/snapd/overlord/state"
+	"github.com/snapcore/snapd/snap"
+)
+
+// CheckAutoConnect is the task-free core of the auto-connect policy check:
+// it answers "would this plug/slot pair auto-connect today" without ever
+// touching a *state.Task, so the connect/auto-connect task handlers, this
+// package's own reload path, a future "snap interfaces --dry-run" API and
+// policy-audit tooling can all ask the same question the same way. Unlike
+// CheckAutoconnectCandidate, which this wraps, it separates the two ways
+// the answer can be "no": allowed is false with a nil err when the
+// assertion-based policy or the interface's own AutoConnect callback
+// simply decline the pair, and err is non-nil only when the check itself
+// could not be completed (eg. an unknown interface or a broken
+// declaration lookup, the latter surfaced as a *policyLookupError) - the
+// distinction a caller that aggregates many pairs, like
+// AutoConnectCandidates, needs in order to skip the former and surface the
+// latter rather than silently treating an un-askable question as a denial.
+func CheckAutoConnect(st *state.State, plug *snap.PlugInfo, slot *snap.SlotInfo, deviceCtx snapstate.DeviceContext) (allowed bool, err error) {
+	if err := CheckAutoconnectCandidate(st, plug, slot, deviceCtx); err != nil {
+		if _, unknownIface := err.(unknownInterfaceError); unknownIface {
+			return false, err
+		}
+		if _, lookupFailure := err.(*policyLookupError); lookupFailure {
+			return false, err
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// AutoConnectCandidates returns every plug/slot pair involving instanceName
+// that the auto-connection policy and the interfaces' own AutoConnect
+// callbacks would currently allow to connect. It only reads state and the
+// interface repository - no task or change is created - so REST handlers,
+// "snap connections --candidate"-style UX and test harnesses can ask the
+// same question the auto-connect task answers during a real refresh.
+//
+// This and CheckAutoConnect are the task-free half of the auto-connect
+// policy check; making doAutoConnect itself a thin wrapper around
+// CheckAutoConnect, and exposing AutoConnectCandidates through the daemon
+// for GET /v2/connections, both happen at those call sites, which live
+// outside this tree's slice of ifacestate.
+func AutoConnectCandidates(st *state.State, instanceName string, deviceCtx snapstate.DeviceContext) ([]*interfaces.ConnRef, error) {
+	repo := ifacerepo.Get(st)
+
+	var candidates []*interfaces.ConnRef
+	for _, plug := range repo.Plugs(instanceName) {
+		for _, slot := range repo.AllSlots(plug.Interface) {
+			allowed, err := CheckAutoConnect(st, plug, slot, deviceCtx)
+			if err != nil {
+				return nil, err
+			}
+			if !allowed {
+				continue
+			}
+			candidates = append(candidates, &interfaces.ConnRef{
+				PlugRef: interfaces.PlugRef{Snap: plug.Snap.InstanceName(), Name: plug.Name},
+				SlotRef: interfaces.SlotRef{Snap: slot.Snap.InstanceName(), Name: slot.Name},
+			})
+		}
+	}
+	for _, slot := range repo.Slots(instanceName) {
+		for _, plug := range repo.AllPlugs(slot.Interface) {
+			if plug.Snap.InstanceName() == instanceName {
+				// already covered by the loop above
+				continue
+			}
+			allowed, err := CheckAutoConnect(st, plug, slot, deviceCtx)
+			if err != nil {
+				return nil, err
+			}
+			if !allowed {
+				continue
+			}
+			candidates = append(candidates, &interfaces.ConnRef{
+				PlugRef: interfaces.PlugRef{Snap: plug.Snap.InstanceName(), Name: plug.Name},
+				SlotRef: interfaces.SlotRef{Snap: slot.Snap.InstanceName(), Name: slot.Name},
+			})
+		}
+	}
+	return candidates, nil
+}
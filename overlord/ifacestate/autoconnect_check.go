@@ -0,0 +1,67 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package ifacestate
+
+import (
+	"fmt"
+
+	"github.com/snapcore/snapd/overlord/ifacestate/ifacerepo"
+	"github.com/snapcore/snapd/overlord/snapstate"
+	"github.com/snapcore/snapd/overlord/state"
+	"github.com/snapcore/snapd/snap"
+)
+
+// unknownInterfaceError is returned by CheckAutoconnectCandidate when the
+// plug's interface is not known to the repository. It is its own type,
+// rather than a plain fmt.Errorf, so that callers aggregating many
+// plug/slot pairs (CheckAutoConnect) can tell this internal inconsistency
+// apart from a policy simply declining the pair.
+type unknownInterfaceError struct {
+	iface string
+}
+
+func (e unknownInterfaceError) Error() string {
+	return fmt.Sprintf("internal error: unknown interface %q", e.iface)
+}
+
+// CheckAutoconnectCandidate reports whether plug and slot would be
+// auto-connected today: it consults the assertion-based auto-connection
+// policy (base declaration plus any snap-declarations) and then the
+// interface's own AutoConnect callback, exactly as doAutoConnect does for a
+// candidate pair, but without needing a *state.Task in scope. Callers such
+// as connection reload, hotplug re-evaluation, or any other non-task tool
+// can use this directly; the task handlers are expected to become thin
+// wrappers around it.
+func CheckAutoconnectCandidate(st *state.State, plug *snap.PlugInfo, slot *snap.SlotInfo, deviceCtx snapstate.DeviceContext) error {
+	cand, err := connectCandidate(st, plug, slot, deviceCtx)
+	if err != nil {
+		return err
+	}
+	if err := cand.CheckAutoConnect(); err != nil {
+		return err
+	}
+
+	repo := ifacerepo.Get(st)
+	iface := repo.Interface(plug.Interface)
+	if iface == nil {
+		return unknownInterfaceError{iface: plug.Interface}
+	}
+	return iface.AutoConnect(plug, slot)
+}
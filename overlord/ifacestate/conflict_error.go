@@ -0,0 +1,87 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package ifacestate
+
+import "fmt"
+
+// ConflictKind identifies the kind of change that a ConflictError says is
+// already in progress for a snap.
+type ConflictKind string
+
+const (
+	ConflictKindInstall     ConflictKind = "install"
+	ConflictKindRemove      ConflictKind = "remove"
+	ConflictKindRefresh     ConflictKind = "refresh"
+	ConflictKindConnect     ConflictKind = "connect"
+	ConflictKindAutoconnect ConflictKind = "autoconnect"
+	ConflictKindDisconnect  ConflictKind = "disconnect"
+)
+
+// ConflictError describes a plug or slot's snap that already has a
+// conflicting change in progress. It carries, as separate fields, the
+// information a retry message holds in a free-form string, so a caller
+// holding one can act on it without parsing Error(). Connect, Disconnect
+// and CheckAutoconnectConflicts do not return it: they return a bare
+// *state.Retry.
+type ConflictError struct {
+	// Snap is the snap whose in-progress change caused the conflict.
+	Snap string
+	// ConflictingChangeID is the id of the change already in progress.
+	ConflictingChangeID string
+	// ConflictingTaskKind is the kind of the task within that change which
+	// triggered the conflict (eg. "link-snap", "connect", "auto-connect").
+	ConflictingTaskKind string
+	// Kind describes the operation that could not proceed because of the
+	// conflict.
+	Kind ConflictKind
+}
+
+// Error implements the error interface. The message intentionally matches
+// the historical "snap %q has %q change in progress" wording so that code
+// (and tests) matching on the string keep working unchanged.
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("snap %q has %q change in progress", e.Snap, e.ConflictingChangeID)
+}
+
+// NewConflictError builds a ConflictError for snapName, describing the
+// conflicting change and the task kind that is blocking kind from
+// proceeding. Nothing in this package calls it outside tests: Connect,
+// Disconnect and CheckAutoconnectConflicts return a *state.Retry directly,
+// and no daemon-side code forwards kind/snap-name/change-id to API clients.
+func NewConflictError(kind ConflictKind, snapName, conflictingChangeID, conflictingTaskKind string) *ConflictError {
+	return &ConflictError{
+		Snap:                snapName,
+		ConflictingChangeID: conflictingChangeID,
+		ConflictingTaskKind: conflictingTaskKind,
+		Kind:                kind,
+	}
+}
+
+// AsConflictError reports whether err is a *ConflictError, the same way
+// callers already type-assert for *policyLookupError or
+// unknownInterfaceError elsewhere in this package. It gives every caller
+// that needs to tell a ConflictError apart from any other failure one place
+// to do it rather than repeating the type assertion; a *state.Retry, which
+// is what Connect/Disconnect/CheckAutoconnectConflicts return on conflict,
+// is not a ConflictError and is reported as false.
+func AsConflictError(err error) (*ConflictError, bool) {
+	conflictErr, ok := err.(*ConflictError)
+	return conflictErr, ok
+}
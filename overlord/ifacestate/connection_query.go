@@ -0,0 +1,135 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package ifacestate
+
+import (
+	"fmt"
+
+	"github.com/snapcore/snapd/interfaces"
+	"github.com/snapcore/snapd/overlord/state"
+)
+
+// ConnectionFilter narrows QueryConnections down to the subset of stored
+// connections a caller cares about, so callers like "snap connections" and
+// the REST API don't have to walk the raw conns map and post-filter it
+// themselves. The zero value matches every connection; each non-zero field
+// narrows further, and multiple fields are ANDed together.
+type ConnectionFilter struct {
+	Interface       string
+	Snap            string
+	HotplugKey      string
+	OnlyConnected   bool
+	OnlyHotplugGone bool
+}
+
+func (f *ConnectionFilter) matches(connRef *interfaces.ConnRef, cstate connState) bool {
+	if f.Interface != "" && cstate.Interface != f.Interface {
+		return false
+	}
+	if f.Snap != "" && connRef.PlugRef.Snap != f.Snap && connRef.SlotRef.Snap != f.Snap {
+		return false
+	}
+	if f.HotplugKey != "" && cstate.HotplugKey != f.HotplugKey {
+		return false
+	}
+	if f.OnlyConnected && (cstate.Undesired || cstate.HotplugGone) {
+		return false
+	}
+	if f.OnlyHotplugGone && !cstate.HotplugGone {
+		return false
+	}
+	return true
+}
+
+// ConnectionDetails is the filtered, read-only view QueryConnections
+// returns for each matching connection. It carries everything
+// InterfaceManager.ConnectionStates' ConnectionState is meant to grow -
+// HotplugKey, HotplugGone, both attr generations, and LastConnectedAt - so
+// that once InterfaceManager grows a QueryConnections method of its own,
+// it can build each entry straight from this.
+type ConnectionDetails struct {
+	Interface        string
+	Auto             bool
+	ByGadget         bool
+	Undesired        bool
+	HotplugKey       string
+	HotplugGone      bool
+	StaticPlugAttrs  map[string]interface{}
+	DynamicPlugAttrs map[string]interface{}
+	StaticSlotAttrs  map[string]interface{}
+	DynamicSlotAttrs map[string]interface{}
+	LastConnectedAt  string
+}
+
+// QueryConnections filters the stored "conns" state through filter,
+// keyed the same way conns itself is (plug-ref space slot-ref).
+//
+// LastConnectedAt is read from the raw "connected-at" entry that schema v2
+// backfills (see MigrateConnsSchema) rather than from connState, since a
+// stored connection's typed fields don't carry it yet.
+//
+// This is the handler-independent half of what would become
+// InterfaceManager.QueryConnections: the InterfaceManager method itself,
+// and wiring "snap connections"/the REST API to call it instead of
+// post-filtering ConnectionStates, live outside this tree.
+func QueryConnections(st *state.State, filter ConnectionFilter) (map[string]ConnectionDetails, error) {
+	conns, err := getConns(st)
+	if err != nil {
+		return nil, fmt.Errorf("cannot obtain connections: %v", err)
+	}
+
+	var raw map[string]interface{}
+	if err := st.Get("conns", &raw); err != nil && err != state.ErrNoState {
+		return nil, fmt.Errorf("cannot obtain connections: %v", err)
+	}
+
+	result := make(map[string]ConnectionDetails)
+	for id, cstate := range conns {
+		connRef, err := interfaces.ParseConnRef(id)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse connection identifier %q: %v", id, err)
+		}
+		if !filter.matches(connRef, cstate) {
+			continue
+		}
+
+		var connectedAt string
+		if entry, ok := raw[id].(map[string]interface{}); ok {
+			if v, ok := entry["connected-at"].(string); ok {
+				connectedAt = v
+			}
+		}
+
+		result[id] = ConnectionDetails{
+			Interface:        cstate.Interface,
+			Auto:             cstate.Auto,
+			ByGadget:         cstate.ByGadget,
+			Undesired:        cstate.Undesired,
+			HotplugKey:       cstate.HotplugKey,
+			HotplugGone:      cstate.HotplugGone,
+			StaticPlugAttrs:  cstate.StaticPlugAttrs,
+			DynamicPlugAttrs: cstate.DynamicPlugAttrs,
+			StaticSlotAttrs:  cstate.StaticSlotAttrs,
+			DynamicSlotAttrs: cstate.DynamicSlotAttrs,
+			LastConnectedAt:  connectedAt,
+		}
+	}
+	return result, nil
+}
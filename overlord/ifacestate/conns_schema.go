@@ -0,0 +1,167 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package ifacestate
+
+import (
+	"fmt"
+
+	"github.com/snapcore/snapd/overlord/state"
+)
+
+// connsVersionKey is the state key stamped alongside "conns" recording
+// which schema generation the stored entries were last migrated to.
+// Older snapd never wrote this key at all, which is what distinguishes v0
+// (pre-versioning) state from anything that has gone through
+// MigrateConnsSchema at least once.
+const connsVersionKey = "conns-version"
+
+// currentConnsSchemaVersion is the schema generation this snapd writes and
+// expects to read; bump it and register a migration to it whenever a new
+// "conns" field is introduced that older entries need backfilling for
+// (the policy-driven static-attr refresh and per-connection metadata like
+// connection time both motivated this).
+const currentConnsSchemaVersion = 2
+
+// ConnsSchemaVersion returns the schema generation this snapd writes,
+// mainly so tests can assert against it instead of a hardcoded literal.
+func ConnsSchemaVersion() int {
+	return currentConnsSchemaVersion
+}
+
+// ConnsSchemaTooNewError is returned by MigrateConnsSchema when the stored
+// "conns-version" is newer than this snapd understands, eg. after a
+// downgrade. There is no sensible migration backwards, so the caller -
+// ultimately the daemon at startup - is expected to refuse to run rather
+// than silently misinterpret fields it doesn't know about.
+type ConnsSchemaTooNewError struct {
+	Stored, Running int
+}
+
+func (e *ConnsSchemaTooNewError) Error() string {
+	return fmt.Sprintf("cannot downgrade: installed snapd understands conns schema up to version %d, but state was last written at version %d", e.Running, e.Stored)
+}
+
+// ConnsMigrationFunc migrates the raw "conns" map (the same
+// map[string]interface{} shape state.Get("conns", ...) would hand back
+// without a connState unmarshal target) from one schema version to the
+// next. It operates on the raw shape rather than ifacestate's connState
+// struct so that it can run - and be tested - against exactly the bytes an
+// older or newer snapd actually wrote, without having to keep connState
+// itself able to represent every historical shape.
+type ConnsMigrationFunc func(conns map[string]interface{}) error
+
+type connsMigration struct {
+	from, to int
+	migrate  ConnsMigrationFunc
+}
+
+var connsMigrations []connsMigration
+
+// RegisterConnsMigration registers fn as the migration that brings the
+// stored "conns" map from schema version from to version to. Migrations
+// are applied in the order needed to reach currentConnsSchemaVersion from
+// whatever version is stored, one step at a time, so each migration only
+// ever has to know about the single version immediately before it.
+func RegisterConnsMigration(from, to int, fn ConnsMigrationFunc) {
+	connsMigrations = append(connsMigrations, connsMigration{from: from, to: to, migrate: fn})
+}
+
+func init() {
+	// v0 -> v1: state written by any snapd before schema versioning
+	// existed at all. There is nothing to change about the entries
+	// themselves, only the version stamp is new.
+	RegisterConnsMigration(0, 1, func(conns map[string]interface{}) error {
+		return nil
+	})
+
+	// v1 -> v2: backfill "connected-at" for entries that predate it, and
+	// normalize "hotplug-gone" to always be present and boolean rather
+	// than implicitly absent-means-false, which is how
+	// TestHotplugConnect/TestHotplugDisconnect era state left it.
+	RegisterConnsMigration(1, 2, func(conns map[string]interface{}) error {
+		for id, raw := range conns {
+			entry, ok := raw.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("cannot migrate conns entry %q to schema v2: unexpected type %T", id, raw)
+			}
+			if _, ok := entry["connected-at"]; !ok {
+				entry["connected-at"] = ""
+			}
+			if _, ok := entry["hotplug-gone"]; !ok {
+				entry["hotplug-gone"] = false
+			}
+			conns[id] = entry
+		}
+		return nil
+	})
+}
+
+// MigrateConnsSchema brings the "conns" state entry up to
+// currentConnsSchemaVersion, running every registered migration in
+// sequence starting from whatever version is currently stored (v0 if
+// "conns-version" was never written at all). It must be called while
+// holding the state lock, before reloadConnections, so that nothing reads
+// "conns" in its pre-migration shape during manager startup.
+//
+// If the stored version is newer than currentConnsSchemaVersion - the
+// state was last written by a newer snapd - migration is refused with a
+// *ConnsSchemaTooNewError instead of guessing at fields this snapd doesn't
+// know about yet.
+func MigrateConnsSchema(st *state.State) error {
+	var conns map[string]interface{}
+	if err := st.Get("conns", &conns); err != nil && err != state.ErrNoState {
+		return fmt.Errorf("cannot obtain connections: %v", err)
+	}
+	if conns == nil {
+		conns = make(map[string]interface{})
+	}
+
+	version := 0
+	if err := st.Get(connsVersionKey, &version); err != nil && err != state.ErrNoState {
+		return fmt.Errorf("cannot obtain conns schema version: %v", err)
+	}
+
+	if version > currentConnsSchemaVersion {
+		return &ConnsSchemaTooNewError{Stored: version, Running: currentConnsSchemaVersion}
+	}
+	if version == currentConnsSchemaVersion {
+		return nil
+	}
+
+	byFrom := make(map[int]connsMigration, len(connsMigrations))
+	for _, m := range connsMigrations {
+		byFrom[m.from] = m
+	}
+
+	for version < currentConnsSchemaVersion {
+		m, ok := byFrom[version]
+		if !ok {
+			return fmt.Errorf("cannot migrate conns schema from version %d: no migration registered", version)
+		}
+		if err := m.migrate(conns); err != nil {
+			return fmt.Errorf("cannot migrate conns schema from version %d to %d: %v", m.from, m.to, err)
+		}
+		version = m.to
+	}
+
+	st.Set("conns", conns)
+	st.Set(connsVersionKey, version)
+	return nil
+}
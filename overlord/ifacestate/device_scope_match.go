@@ -0,0 +1,133 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package ifacestate
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/snapcore/snapd/overlord/snapstate"
+)
+
+// DeviceScopeConstraints mirrors the on-store/on-brand/on-model/on-serial
+// lists a base-declaration or snap-declaration rule may carry alongside
+// allow-installation/deny-installation/allow-connection/
+// allow-auto-connection. on-store is already understood natively by
+// interfaces/policy; on-brand, on-model and on-serial are not, so evaluating
+// them requires this type and DeviceScopeConstraintsMatch.
+//
+// policy.ConnectCandidate, policy.InstallCandidate and CheckInterfaces do
+// not call DeviceScopeConstraintsMatch or CheckDeviceScopeConstraints, and
+// nothing extracts a rule's on-brand/on-model/on-serial lists into this
+// type, so allow-installation, allow-connection and allow-auto-connection
+// checks are not scoped by those lists; only on-store is evaluated there.
+// Nothing in this package calls DeviceScopeConstraintsMatch or
+// CheckDeviceScopeConstraints outside tests, ReconcileDeviceScope
+// included.
+type DeviceScopeConstraints struct {
+	// OnBrand lists allowed brand account-ids, eg. "my-brand".
+	OnBrand []string
+	// OnModel lists allowed "brand/model" pairs, eg. "my-brand/my-model".
+	OnModel []string
+	// OnSerial lists allowed serials, which may use the same glob syntax
+	// "friendly-stores" style matching doesn't need but a fleet-specific
+	// allowlist does, eg. "1234*".
+	OnSerial []string
+}
+
+// Empty reports whether none of the constraint lists are set, ie. whatever
+// they're attached to imposes no brand/model/serial restriction.
+func (c DeviceScopeConstraints) Empty() bool {
+	return len(c.OnBrand) == 0 && len(c.OnModel) == 0 && len(c.OnSerial) == 0
+}
+
+// deviceSerial is implemented by device contexts that know the device's
+// serial, which snapstate.DeviceContext itself does not expose (the serial
+// assertion lives alongside, not inside, the model assertion). Test doubles
+// and the real device context used by ReconcileDeviceScope's callers can
+// implement it; when they don't, on-serial constraints are treated as
+// unsatisfiable rather than silently ignored, since "no serial to check
+// against" is not the same as "no constraint".
+type deviceSerial interface {
+	Serial() string
+}
+
+// DeviceScopeConstraintsMatch reports whether deviceCtx's brand, model and
+// (if known) serial satisfy every non-empty list in c. A nil deviceCtx only
+// matches an empty c - there is no model to check brand/model/serial
+// constraints against.
+func DeviceScopeConstraintsMatch(deviceCtx snapstate.DeviceContext, c DeviceScopeConstraints) (bool, error) {
+	if c.Empty() {
+		return true, nil
+	}
+	if deviceCtx == nil {
+		return false, nil
+	}
+	model := deviceCtx.Model()
+	if model == nil {
+		return false, nil
+	}
+
+	if len(c.OnBrand) > 0 && !matchesAny(c.OnBrand, model.BrandID()) {
+		return false, nil
+	}
+	if len(c.OnModel) > 0 && !matchesAny(c.OnModel, fmt.Sprintf("%s/%s", model.BrandID(), model.Model())) {
+		return false, nil
+	}
+	if len(c.OnSerial) > 0 {
+		serialed, ok := deviceCtx.(deviceSerial)
+		if !ok || serialed.Serial() == "" {
+			return false, nil
+		}
+		if !matchesAny(c.OnSerial, serialed.Serial()) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// CheckDeviceScopeConstraints is DeviceScopeConstraintsMatch with the same
+// error-returning shape CheckAutoconnectCandidate and checkConnectCandidate
+// use: nil when c is satisfied, a plain error describing the mismatch
+// otherwise. It exists so that whichever caller ends up threading raw
+// on-brand/on-model/on-serial lists through to this package can fold the
+// result into those checks without re-deriving the error string each time.
+func CheckDeviceScopeConstraints(deviceCtx snapstate.DeviceContext, c DeviceScopeConstraints) error {
+	ok, err := DeviceScopeConstraintsMatch(deviceCtx, c)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("device does not match the required brand/model/serial scope")
+	}
+	return nil
+}
+
+// matchesAny reports whether value matches any of patterns, using
+// filepath.Match so on-serial entries like "1234*" can allowlist a whole
+// batch of devices instead of listing every serial individually.
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package ifacestate
+
+import (
+	"fmt"
+
+	"github.com/snapcore/snapd/interfaces"
+	"github.com/snapcore/snapd/logger"
+	"github.com/snapcore/snapd/overlord/ifacestate/ifacerepo"
+	"github.com/snapcore/snapd/overlord/snapstate"
+	"github.com/snapcore/snapd/overlord/state"
+)
+
+// ReconcileDeviceScope re-evaluates every snap's "auto": true connections
+// against deviceCtx, the device context that follows a remodel, a serial
+// change or a friendly-stores update. Called right after one of those
+// events lands, it re-applies whatever device-scope constraints the
+// auto-connection policy check itself evaluates against deviceCtx, without
+// waiting for the next snap refresh; it does not consult on-serial lists or
+// DeviceScopeConstraints:
+//
+//   - connections the new scope no longer allows are marked undesired and
+//     disconnected, same as RefreshConnectionsStaticAttrs does for a stale
+//     snap.yaml, so the affected snap's security profile drops them;
+//   - plug/slot pairs the new scope newly allows, and that AutoConnect
+//     itself would also accept, are connected and recorded with auto:
+//     true, exactly as doAutoConnect would for a fresh install.
+//
+// Unlike a snap refresh, this isn't rooted in a single task, so the
+// reconciliation is applied directly to state and the interface
+// repository rather than via a change; callers that want user-visible
+// progress should wrap the call in a task of their own. As with every other
+// reload/refresh variant in this package, every snap on either side of a
+// connection that was disconnected or established has its security profile
+// regenerated via SetupAffectedSnapsSecurity afterwards, so the repository
+// change actually takes effect instead of only updating state.
+func ReconcileDeviceScope(st *state.State, deviceCtx snapstate.DeviceContext) error {
+	repo := ifacerepo.Get(st)
+
+	conns, err := getConns(st)
+	if err != nil {
+		return fmt.Errorf("cannot obtain connections: %v", err)
+	}
+
+	changed := false
+	affected := make(map[string]bool)
+
+	// Drop auto-connections the new device scope no longer allows.
+	for id, cstate := range conns {
+		if !cstate.Auto || cstate.HotplugGone || cstate.Undesired {
+			continue
+		}
+		connRef, err := interfaces.ParseConnRef(id)
+		if err != nil {
+			logger.Noticef("cannot parse connection identifier %q: %v", id, err)
+			continue
+		}
+		plug := repo.Plug(connRef.PlugRef.Snap, connRef.PlugRef.Name)
+		slot := repo.Slot(connRef.SlotRef.Snap, connRef.SlotRef.Name)
+		if plug == nil || slot == nil {
+			continue
+		}
+		allowed, err := CheckAutoConnect(st, plug, slot, deviceCtx)
+		if err != nil {
+			logger.Noticef("cannot re-evaluate auto-connection %s against the current device scope: %v", connRef, err)
+			continue
+		}
+		if allowed {
+			continue
+		}
+		if err := repo.Disconnect(connRef.PlugRef.Snap, connRef.PlugRef.Name, connRef.SlotRef.Snap, connRef.SlotRef.Name); err != nil {
+			logger.Noticef("cannot disconnect %s after the device scope stopped allowing it: %v", connRef, err)
+			continue
+		}
+		cstate.Undesired = true
+		conns[id] = cstate
+		changed = true
+		affected[connRef.PlugRef.Snap] = true
+		affected[connRef.SlotRef.Snap] = true
+	}
+
+	// Establish auto-connections the new device scope newly allows.
+	for _, snapName := range snapNamesWithPlugsOrSlots(repo) {
+		candidates, err := AutoConnectCandidates(st, snapName, deviceCtx)
+		if err != nil {
+			logger.Noticef("cannot compute auto-connect candidates for %q against the current device scope: %v", snapName, err)
+			continue
+		}
+		for _, connRef := range candidates {
+			id := connRef.ID()
+			if cstate, ok := conns[id]; ok && !cstate.Undesired {
+				// already connected
+				continue
+			}
+			plug := repo.Plug(connRef.PlugRef.Snap, connRef.PlugRef.Name)
+			slot := repo.Slot(connRef.SlotRef.Snap, connRef.SlotRef.Name)
+			if plug == nil || slot == nil {
+				continue
+			}
+			if _, err := repo.Connect(connRef, plug.Attrs, nil, slot.Attrs, nil, nil); err != nil {
+				logger.Noticef("cannot auto-connect %s under the current device scope: %v", connRef, err)
+				continue
+			}
+			conns[id] = connState{
+				Interface:       plug.Interface,
+				Auto:            true,
+				ByGadget:        false,
+				StaticPlugAttrs: plug.Attrs,
+				StaticSlotAttrs: slot.Attrs,
+			}
+			changed = true
+			affected[connRef.PlugRef.Snap] = true
+			affected[connRef.SlotRef.Snap] = true
+		}
+	}
+
+	if changed {
+		setConns(st, conns)
+		if err := SetupAffectedSnapsSecurity(st, sortedSnapNames(affected)); err != nil {
+			return fmt.Errorf("cannot regenerate security profiles after reconciling device scope: %v", err)
+		}
+	}
+	return nil
+}
+
+// snapNamesWithPlugsOrSlots lists every installed snap that has at least
+// one plug or slot in the repository, so ReconcileDeviceScope only has to
+// ask AutoConnectCandidates about snaps that could possibly connect to
+// anything.
+func snapNamesWithPlugsOrSlots(repo *interfaces.Repository) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, plug := range repo.AllPlugs("") {
+		name := plug.Snap.InstanceName()
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, slot := range repo.AllSlots("") {
+		name := slot.Snap.InstanceName()
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,35 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package ifacestate
+
+import (
+	"github.com/snapcore/snapd/overlord/state"
+)
+
+// MockSetupAffectedSnapsSecurity overrides SetupAffectedSnapsSecurity for
+// the duration of a test, returning a restore function that puts the
+// no-op default back.
+func MockSetupAffectedSnapsSecurity(f func(st *state.State, instanceNames []string) error) (restore func()) {
+	old := SetupAffectedSnapsSecurity
+	SetupAffectedSnapsSecurity = f
+	return func() {
+		SetupAffectedSnapsSecurity = old
+	}
+}
@@ -0,0 +1,128 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package ifacestate
+
+import (
+	"github.com/snapcore/snapd/interfaces"
+	"github.com/snapcore/snapd/logger"
+	"github.com/snapcore/snapd/overlord/state"
+)
+
+// GadgetDisconnectDirective mirrors one "disconnections:" entry a gadget.yaml
+// is meant to gain alongside its existing "connections:" list: an explicit
+// plug/slot pair the gadget wants torn down (or kept from ever being
+// auto-connected) rather than established.
+type GadgetDisconnectDirective struct {
+	PlugRef interfaces.PlugRef
+	SlotRef interfaces.SlotRef
+}
+
+// ResolveGadgetDisconnectDirectives turns a gadget's "disconnections:" list
+// into the subset of pairs that are actually connected today, the only ones
+// a disconnect task needs creating for. A directive naming a pair that
+// isn't connected at all is not an error - gadget.yaml may list disconnect
+// directives defensively, for device variants where the pairing never
+// auto-connected in the first place - so it is skipped and logged instead,
+// the same way an unresolvable "connections:" entry is skipped rather than
+// failing the whole gadget-connect task (see TestGadgetConnectSkipUnknown).
+//
+// Unlike the "connections:" list, this is not gated by connect policy: as
+// PreviewDisconnect already documents, disconnecting is never gated by the
+// connect/auto-connect policy in this codebase, only by an in-progress
+// conflicting change - so there is no policy check to bypass here, gadget
+// or not. A "deny-disconnection" rule kind does not exist anywhere in this
+// tree either, so there is nothing to check even if disconnect were
+// policy-gated; inventing one is outside what this change covers.
+//
+// The gadget-connect task handler that would parse gadget.yaml's
+// "disconnections:"/"order:" lists, call this and OrderGadgetConnect-
+// Directives, and chain the resulting disconnect tasks with WaitFor ahead
+// of the connect tasks does not exist in this tree, so that wiring - and
+// the conflict-retry test that would exercise it end to end - has to
+// happen at that call site.
+func ResolveGadgetDisconnectDirectives(st *state.State, directives []GadgetDisconnectDirective) (toDisconnect []*interfaces.ConnRef, err error) {
+	conns, err := getConns(st)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range directives {
+		connRef := &interfaces.ConnRef{PlugRef: d.PlugRef, SlotRef: d.SlotRef}
+		cstate, ok := conns[connRef.ID()]
+		if !ok || cstate.Undesired || cstate.HotplugGone {
+			logger.Noticef("gadget disconnect directive for %s skipped: not connected", connRef)
+			continue
+		}
+		toDisconnect = append(toDisconnect, connRef)
+	}
+	return toDisconnect, nil
+}
+
+// GadgetConnectDirective mirrors one "connections:" entry in gadget.yaml:
+// an explicit plug/slot pair the gadget wants connected. It is its own type
+// rather than reusing GadgetDisconnectDirective - which OrderGadgetConnect-
+// Directives used to take - since the two lists are ordered and resolved
+// independently and giving them distinct types keeps a "connections:" entry
+// from being passed where a "disconnections:" entry was meant, or vice
+// versa.
+type GadgetConnectDirective struct {
+	PlugRef interfaces.PlugRef
+	SlotRef interfaces.SlotRef
+}
+
+// OrderGadgetConnectDirectives reorders directives so that every plug named
+// in order comes before the plugs not mentioned in it, while otherwise
+// preserving the relative order directives were given in, and preserving
+// the relative order of the order hint itself. It is meant to feed the
+// gadget-connect task handler's "connect" task creation loop, so the tasks
+// it builds can be chained with WaitFor edges in the sequence the gadget
+// asked for instead of gadget.yaml's incidental list order; the handler
+// still has to build those edges from the returned order itself, since
+// task creation is its job, not this helper's.
+//
+// A plug can appear in more than one directive (eg. connected to different
+// slots), so ranks are collected in slices keyed by order index rather than
+// a single directive per rank - otherwise all but the last directive
+// sharing a ranked plug would silently be dropped.
+func OrderGadgetConnectDirectives(directives []GadgetConnectDirective, order []interfaces.PlugRef) []GadgetConnectDirective {
+	if len(order) == 0 {
+		return directives
+	}
+
+	rank := make(map[interfaces.PlugRef]int, len(order))
+	for i, plugRef := range order {
+		rank[plugRef] = i
+	}
+
+	ordered := make([]GadgetConnectDirective, 0, len(directives))
+	var rest []GadgetConnectDirective
+	byRank := make(map[int][]GadgetConnectDirective, len(order))
+	for _, d := range directives {
+		if i, ok := rank[d.PlugRef]; ok {
+			byRank[i] = append(byRank[i], d)
+		} else {
+			rest = append(rest, d)
+		}
+	}
+	for i := range order {
+		ordered = append(ordered, byRank[i]...)
+	}
+	return append(ordered, rest...)
+}
@@ -0,0 +1,124 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package ifacestate
+
+import "path/filepath"
+
+// HotplugDeviceMatchPredicate is one udev match an interface can ask to be
+// filtered/dispatched on: the zero value of a field means "don't care about
+// this property", so an interface only needs to set the fields it actually
+// cares about. VendorIDGlob/ModelIDGlob are filepath.Match-style globs
+// rather than exact matches, since vendors frequently register a whole ID
+// range for a product family. Attrs matches ID_* and other udev ATTR{...}
+// properties by exact value.
+//
+// This mirrors what interfaces/hotplug.HotplugDeviceMatcher is meant to
+// return for an interface that wants cheaper dispatch than "ask every
+// hotplug-capable interface about every device". Defining that interface
+// in interfaces/hotplug, having Manager collect each registered
+// interface's predicates into the map MatchingHotplugInterfaces expects,
+// and passing the aggregated filter into udevmonitor.New all live outside
+// this snapshot, so this only covers the handler-independent
+// matching/aggregation logic such a matcher interface would need.
+type HotplugDeviceMatchPredicate struct {
+	Subsystem        string
+	DevType          string
+	VendorIDGlob     string
+	ModelIDGlob      string
+	Attrs            map[string]string
+	WantsEnumeration bool
+}
+
+// Matches reports whether device's udev properties satisfy every predicate
+// field that was actually set; an empty predicate matches everything.
+func (p HotplugDeviceMatchPredicate) Matches(props map[string]string) bool {
+	if p.Subsystem != "" && props["SUBSYSTEM"] != p.Subsystem {
+		return false
+	}
+	if p.DevType != "" && props["DEVTYPE"] != p.DevType {
+		return false
+	}
+	if p.VendorIDGlob != "" {
+		if ok, err := filepath.Match(p.VendorIDGlob, props["ID_VENDOR_ID"]); err != nil || !ok {
+			return false
+		}
+	}
+	if p.ModelIDGlob != "" {
+		if ok, err := filepath.Match(p.ModelIDGlob, props["ID_MODEL_ID"]); err != nil || !ok {
+			return false
+		}
+	}
+	for attr, want := range p.Attrs {
+		if props[attr] != want {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchingHotplugInterfaces ORs together every predicate list in
+// predicatesByInterface and returns the names of the interfaces that have
+// at least one predicate matching props, so a udev event only has to be
+// dispatched to those interfaces instead of fanned out to every
+// hotplug-capable one. An interface with no predicates registered at all
+// is treated as wanting every device, preserving the fallback behavior for
+// interfaces that don't implement the matcher.
+func MatchingHotplugInterfaces(predicatesByInterface map[string][]HotplugDeviceMatchPredicate, props map[string]string) []string {
+	var matched []string
+	for iface, predicates := range predicatesByInterface {
+		if len(predicates) == 0 {
+			matched = append(matched, iface)
+			continue
+		}
+		for _, p := range predicates {
+			if p.Matches(props) {
+				matched = append(matched, iface)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// AnyHotplugPredicateWantsEnumeration reports whether at least one
+// predicate across every interface asks to see the udevadm enumeration
+// pass; EnumerationDone must still fire exactly once regardless, but an
+// all-false predicate set (every interface registered predicates and none
+// of them wants enumeration) is what lets the enumeration trigger itself be
+// skipped entirely rather than just filtered. An empty or nil map, like an
+// interface with no predicates, means the fallback "every device" behavior.
+func AnyHotplugPredicateWantsEnumeration(predicatesByInterface map[string][]HotplugDeviceMatchPredicate) bool {
+	if len(predicatesByInterface) == 0 {
+		return true
+	}
+	for _, predicates := range predicatesByInterface {
+		if len(predicates) == 0 {
+			// no predicates registered at all means the fallback "every
+			// device" behavior, which includes enumeration.
+			return true
+		}
+		for _, p := range predicates {
+			if p.WantsEnumeration {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package ifacestate
+
+import "time"
+
+// HotplugDebounceWindowDefault is the quiet window used when
+// core.experimental.hotplug-debounce is unset: the config option itself,
+// and the udevmonitor wiring that would actually read it and feed raw udev
+// events into a HotplugEventCoalescer, live outside this tree, so this only
+// covers the handler-independent coalescing logic and the window it
+// defaults to.
+const HotplugDebounceWindowDefault = 500 * time.Millisecond
+
+// HotplugEventAction is the net udev action a coalesced event represents.
+type HotplugEventAction int
+
+const (
+	HotplugEventAdded HotplugEventAction = iota
+	HotplugEventRemoved
+	HotplugEventChanged
+)
+
+// HotplugEvent is one raw or coalesced udev event for a hotplug-key.
+// Attrs is only meaningful for Added/Changed.
+type HotplugEvent struct {
+	Action HotplugEventAction
+	Attrs  map[string]string
+}
+
+// hotplugKeyState tracks the net effect of every event folded into it so
+// far for one hotplug-key, seeded from whatever the key's slot already
+// looked like in "hotplug-slots" before the burst started.
+type hotplugKeyState struct {
+	baselinePresent bool
+	baselineAttrs   map[string]string
+	present         bool
+	attrs           map[string]string
+}
+
+// HotplugEventCoalescer collapses a burst of udev add/remove/change events
+// for the same hotplug-key, arriving within a quiet window, down to the
+// single net change that actually needs scheduling. USB re-enumeration and
+// flaky cables routinely produce rapid add/remove/add bursts for one
+// device; without coalescing, the manager schedules and serializes (via
+// hotplug-seq) a full hotplug change per raw event instead of the one that
+// matters.
+type HotplugEventCoalescer struct {
+	window  time.Duration
+	pending map[string]*hotplugKeyState
+}
+
+// NewHotplugEventCoalescer returns a coalescer that folds events arriving
+// for the same hotplug-key within window of each other; callers flush a
+// key once window has passed since its last enqueued event.
+func NewHotplugEventCoalescer(window time.Duration) *HotplugEventCoalescer {
+	return &HotplugEventCoalescer{
+		window:  window,
+		pending: make(map[string]*hotplugKeyState),
+	}
+}
+
+// Window is the quiet window this coalescer was constructed with.
+func (c *HotplugEventCoalescer) Window() time.Duration {
+	return c.window
+}
+
+// Enqueue folds ev into the net state for hotplugKey. baselinePresent and
+// baselineAttrs describe the key's slot as currently recorded in
+// "hotplug-slots", and only matter the first time hotplugKey is seen in
+// this window; they are what let Flush recognize a burst that nets out to
+// exactly where the slot already was.
+func (c *HotplugEventCoalescer) Enqueue(hotplugKey string, ev HotplugEvent, baselinePresent bool, baselineAttrs map[string]string) {
+	st, ok := c.pending[hotplugKey]
+	if !ok {
+		st = &hotplugKeyState{
+			baselinePresent: baselinePresent,
+			baselineAttrs:   baselineAttrs,
+			present:         baselinePresent,
+			attrs:           baselineAttrs,
+		}
+		c.pending[hotplugKey] = st
+	}
+
+	switch ev.Action {
+	case HotplugEventAdded:
+		st.present = true
+		st.attrs = ev.Attrs
+	case HotplugEventRemoved:
+		st.present = false
+		st.attrs = nil
+	case HotplugEventChanged:
+		if st.present {
+			st.attrs = ev.Attrs
+		}
+	}
+}
+
+// Flush reports the single net event to act on for hotplugKey, clearing
+// its pending state. ok is false when nothing needs to happen at all: the
+// canonical add+remove (or remove+add) cancel-out, where the burst begins
+// and ends on the same presence and attrs as the recorded baseline.
+func (c *HotplugEventCoalescer) Flush(hotplugKey string) (ev HotplugEvent, ok bool) {
+	st, found := c.pending[hotplugKey]
+	if !found {
+		return HotplugEvent{}, false
+	}
+	delete(c.pending, hotplugKey)
+
+	if st.present == st.baselinePresent && stringMapEqual(st.attrs, st.baselineAttrs) {
+		return HotplugEvent{}, false
+	}
+	if !st.present {
+		return HotplugEvent{Action: HotplugEventRemoved}, true
+	}
+	return HotplugEvent{Action: HotplugEventAdded, Attrs: st.attrs}, true
+}
+
+func stringMapEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// SupersededHotplugSeqs returns the seqs superseded once coalescing has
+// decided that only the event at keepSeq for a hotplug-key actually needs
+// to run: hotplug-seq-wait can use this to let every other sequence number
+// in seqs finish as a no-op instead of serializing a full change behind
+// each one. Nothing in this tree calls it yet - extending hotplug-seq-wait
+// itself to consult a coalescer and actually skip the superseded
+// sequences, like reading core.experimental.hotplug-debounce to size the
+// window, is part of the udevmonitor wiring that lives outside this
+// tree's slice of ifacestate.
+func SupersededHotplugSeqs(seqs []int, keepSeq int) []int {
+	var superseded []int
+	for _, seq := range seqs {
+		if seq != keepSeq {
+			superseded = append(superseded, seq)
+		}
+	}
+	return superseded
+}
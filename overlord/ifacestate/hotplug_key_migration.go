@@ -0,0 +1,179 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package ifacestate
+
+import (
+	"fmt"
+
+	"github.com/snapcore/snapd/interfaces"
+	"github.com/snapcore/snapd/logger"
+	"github.com/snapcore/snapd/overlord/state"
+)
+
+// hotplugSlotInfo mirrors one entry of the "hotplug-slots" state map: the
+// slot's identity plus whatever static attrs were derived for it the last
+// time its device was detected.
+type hotplugSlotInfo struct {
+	Name        string                 `json:"name"`
+	Interface   string                 `json:"interface"`
+	HotplugKey  string                 `json:"hotplug-key"`
+	StaticAttrs map[string]interface{} `json:"static-attrs,omitempty"`
+}
+
+func getHotplugSlots(st *state.State) (map[string]hotplugSlotInfo, error) {
+	var slots map[string]hotplugSlotInfo
+	if err := st.Get("hotplug-slots", &slots); err != nil && err != state.ErrNoState {
+		return nil, fmt.Errorf("cannot obtain hotplug slots: %v", err)
+	}
+	return slots, nil
+}
+
+// hotplugKeyReactivationChecker is implemented by interfaces that want a
+// say in whether a connection survives a hotplug key rotation once the
+// device has been rediscovered under its new key. Gadget-predefined slots
+// are never subject to rediscovery, and a plain "is the device still
+// there" check only makes sense for interfaces that track hotplug devices
+// at all, so both predicates are optional: an interface that implements
+// neither gets its connections carried over unchanged, same as before the
+// rotation.
+//
+// This is a stand-in for the real check: in the full tree, "is this slot
+// handled by the gadget" and "has udev actually redetected the device"
+// belong to interfaces.Repository and interfaces/hotplug respectively, not
+// to the interface implementation itself, since both questions need
+// access to state MigrateHotplugKey's caller already has but an individual
+// Interface value does not. Routing through those instead of this
+// per-interface checker, and calling MigrateHotplugKey at all from the
+// udev key-generation-change path that would trigger it, both live outside
+// this tree's slice of ifacestate.
+type hotplugKeyReactivationChecker interface {
+	HandledByGadget(hotplugKey string) bool
+	HotplugDeviceDetected(hotplugKey string) (bool, error)
+}
+
+// MigrateHotplugKey rewrites every "hotplug-slots" entry and every conns
+// entry for iface that currently carries oldKey so that they carry newKey
+// instead, merging newAttrs into the slot's stored static-attrs/slot-static
+// (newAttrs wins on conflicts, everything else already stored is kept).
+// This is for hotplug key generation changes: a udev attribute the key is
+// derived from changes meaning without the physical device changing, and
+// existing connections should follow the device to its new key rather than
+// being torn down and rediscovered from scratch.
+//
+// plug-static is left untouched - newAttrs only ever describes what the
+// slot side contributed, the plug side did not move. For every connection
+// that was rewritten, the interface's own HandledByGadget/
+// HotplugDeviceDetected predicates (when it implements them) are re-run
+// against newKey to decide whether the connection should stay active or be
+// left marked hotplug-gone until the device reappears for real, the same
+// distinction the hotplug-connect/hotplug-remove-slot task handlers make.
+//
+// Nothing in this tree calls MigrateHotplugKey yet: the udev path that
+// detects a key-generation change and decides oldKey/newKey/newAttrs is
+// part of interfaces/hotplug, outside this tree's slice of ifacestate.
+func MigrateHotplugKey(st *state.State, repo *interfaces.Repository, iface, oldKey, newKey string, newAttrs map[string]interface{}) error {
+	if oldKey == newKey {
+		return nil
+	}
+
+	slots, err := getHotplugSlots(st)
+	if err != nil {
+		return err
+	}
+	slotsChanged := false
+	for slotName, slot := range slots {
+		if slot.Interface != iface || slot.HotplugKey != oldKey {
+			continue
+		}
+		slot.HotplugKey = newKey
+		slot.StaticAttrs = mergeAttrs(slot.StaticAttrs, newAttrs)
+		slots[slotName] = slot
+		slotsChanged = true
+	}
+	if slotsChanged {
+		st.Set("hotplug-slots", slots)
+	}
+
+	conns, err := getConns(st)
+	if err != nil {
+		return fmt.Errorf("cannot obtain connections: %v", err)
+	}
+
+	var ifaceObj interfaces.Interface
+	if repo != nil {
+		ifaceObj = repo.Interface(iface)
+	}
+
+	connsChanged := false
+	for id, cstate := range conns {
+		if cstate.Interface != iface || cstate.HotplugKey != oldKey {
+			continue
+		}
+		cstate.HotplugKey = newKey
+		cstate.StaticSlotAttrs = mergeAttrs(cstate.StaticSlotAttrs, newAttrs)
+		if _, ok := ifaceObj.(hotplugKeyReactivationChecker); ok {
+			cstate.HotplugGone = !reactivateAfterKeyMigration(ifaceObj, newKey, id)
+		}
+		conns[id] = cstate
+		connsChanged = true
+	}
+	if connsChanged {
+		setConns(st, conns)
+	}
+
+	return nil
+}
+
+// reactivateAfterKeyMigration reports whether a connection whose hotplug
+// key just migrated to newKey should stay active. It returns true when the
+// interface does not implement hotplugKeyReactivationChecker; MigrateHotplugKey
+// does not consult it for such interfaces at all, so their connections keep
+// the hotplug-gone flag they had before the rotation.
+func reactivateAfterKeyMigration(ifaceObj interfaces.Interface, newKey, connID string) bool {
+	checker, ok := ifaceObj.(hotplugKeyReactivationChecker)
+	if !ok {
+		return true
+	}
+	if checker.HandledByGadget(newKey) {
+		return true
+	}
+	detected, err := checker.HotplugDeviceDetected(newKey)
+	if err != nil {
+		logger.Noticef("cannot determine whether the device behind connection %s is still present after hotplug key migration: %v", connID, err)
+		return true
+	}
+	return detected
+}
+
+// mergeAttrs returns a fresh map holding the entries of base overridden by
+// the entries of overrides; base and overrides are both left untouched.
+func mergeAttrs(base, overrides map[string]interface{}) map[string]interface{} {
+	if len(base) == 0 && len(overrides) == 0 {
+		return nil
+	}
+	merged := make(map[string]interface{}, len(base)+len(overrides))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		merged[k] = v
+	}
+	return merged
+}
@@ -26,6 +26,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -48,6 +49,7 @@ import (
 	"github.com/snapcore/snapd/overlord/ifacestate/ifacerepo"
 	"github.com/snapcore/snapd/overlord/ifacestate/udevmonitor"
 	"github.com/snapcore/snapd/overlord/snapstate"
+	"github.com/snapcore/snapd/overlord/snapstate/snapstatetest"
 	"github.com/snapcore/snapd/overlord/state"
 	"github.com/snapcore/snapd/release"
 	"github.com/snapcore/snapd/snap"
@@ -1571,6 +1573,1612 @@ func (s *interfaceManagerSuite) TestStaleConnectionsRemoved(c *C) {
 	c.Assert(ifaces.Connections, HasLen, 0)
 }
 
+func (s *interfaceManagerSuite) TestRefreshConnectionsStaticAttrsUpdatesOnPolicyAllow(c *C) {
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.mockSnap(c, consumerYaml)
+	s.mockSnap(c, producerYaml)
+	mgr := s.manager(c)
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	s.state.Set("conns", map[string]interface{}{
+		"consumer:plug producer:slot": map[string]interface{}{
+			"interface":   "test",
+			"plug-static": map[string]interface{}{"attr1": "old-value"},
+			"slot-static": map[string]interface{}{"attr2": "old-value"},
+		},
+	})
+
+	c.Assert(ifacestate.RefreshConnectionsStaticAttrs(s.state, mgr.Repository(), nil), IsNil)
+
+	conns, err := ifacestate.GetConns(s.state)
+	c.Assert(err, IsNil)
+	plugStatic, _, slotStatic, _, ok := ifacestate.GetConnStateAttrs(conns, "consumer:plug producer:slot")
+	c.Assert(ok, Equals, true)
+	c.Check(plugStatic, DeepEquals, map[string]interface{}{"attr1": "value1"})
+	c.Check(slotStatic, DeepEquals, map[string]interface{}{"attr2": "value2"})
+}
+
+func (s *interfaceManagerSuite) TestRefreshConnectionsStaticAttrsMarksUndesiredOnBaseDeclarationChange(c *C) {
+	restore := assertstest.MockBuiltinBaseDeclaration([]byte(`
+type: base-declaration
+authority-id: canonical
+series: 16
+slots:
+  test:
+    allow-connection: false
+`))
+	defer restore()
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.mockSnap(c, consumerYaml)
+	s.mockSnap(c, producerYaml)
+	mgr := s.manager(c)
+	repo := mgr.Repository()
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	// the stored attrs already match the snap.yaml exactly - this is not
+	// about the attrs going stale, it is the base declaration itself that
+	// now forbids the connection outright.
+	s.state.Set("conns", map[string]interface{}{
+		"consumer:plug producer:slot": map[string]interface{}{
+			"interface":   "test",
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": "value2"},
+		},
+	})
+
+	c.Assert(ifacestate.RefreshConnectionsStaticAttrs(s.state, repo, &snapstatetest.TrivialDeviceContext{}), IsNil)
+
+	conns, err := ifacestate.GetConns(s.state)
+	c.Assert(err, IsNil)
+	cstate := conns["consumer:plug producer:slot"].(map[string]interface{})
+	c.Check(cstate["undesired"], Equals, true)
+	c.Check(repo.Interfaces().Connections, HasLen, 0)
+}
+
+// TestRefreshConnectionsStaticAttrsRegeneratesSecurityOfAffectedSnaps checks
+// that a connection torn down by the policy re-evaluation above triggers
+// SetupAffectedSnapsSecurity for both snaps on the connection, so the
+// repository change actually reaches their security profiles instead of
+// only updating state.
+func (s *interfaceManagerSuite) TestRefreshConnectionsStaticAttrsRegeneratesSecurityOfAffectedSnaps(c *C) {
+	restore := assertstest.MockBuiltinBaseDeclaration([]byte(`
+type: base-declaration
+authority-id: canonical
+series: 16
+slots:
+  test:
+    allow-connection: false
+`))
+	defer restore()
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.mockSnap(c, consumerYaml)
+	s.mockSnap(c, producerYaml)
+	mgr := s.manager(c)
+	repo := mgr.Repository()
+
+	var setupFor []string
+	restoreSetup := ifacestate.MockSetupAffectedSnapsSecurity(func(st *state.State, instanceNames []string) error {
+		setupFor = instanceNames
+		return nil
+	})
+	defer restoreSetup()
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	s.state.Set("conns", map[string]interface{}{
+		"consumer:plug producer:slot": map[string]interface{}{
+			"interface":   "test",
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": "value2"},
+		},
+	})
+
+	c.Assert(ifacestate.RefreshConnectionsStaticAttrs(s.state, repo, &snapstatetest.TrivialDeviceContext{}), IsNil)
+	c.Check(setupFor, DeepEquals, []string{"consumer", "producer"})
+}
+
+// TestRefreshConnectionsStaticAttrsUpdatesAutoConnectionOnPolicyAllow is the
+// "auto": true counterpart of TestRefreshConnectionsStaticAttrsUpdatesOnPolicyAllow:
+// an auto-connection must keep satisfying both the connect and the
+// auto-connect policy, not just the former, before its stored attrs are
+// refreshed.
+func (s *interfaceManagerSuite) TestRefreshConnectionsStaticAttrsUpdatesAutoConnectionOnPolicyAllow(c *C) {
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.mockSnap(c, consumerYaml)
+	s.mockSnap(c, producerYaml)
+	mgr := s.manager(c)
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	s.state.Set("conns", map[string]interface{}{
+		"consumer:plug producer:slot": map[string]interface{}{
+			"interface":   "test",
+			"auto":        true,
+			"plug-static": map[string]interface{}{"attr1": "old-value"},
+			"slot-static": map[string]interface{}{"attr2": "old-value"},
+		},
+	})
+
+	c.Assert(ifacestate.RefreshConnectionsStaticAttrs(s.state, mgr.Repository(), nil), IsNil)
+
+	conns, err := ifacestate.GetConns(s.state)
+	c.Assert(err, IsNil)
+	plugStatic, _, slotStatic, _, ok := ifacestate.GetConnStateAttrs(conns, "consumer:plug producer:slot")
+	c.Assert(ok, Equals, true)
+	c.Check(plugStatic, DeepEquals, map[string]interface{}{"attr1": "value1"})
+	c.Check(slotStatic, DeepEquals, map[string]interface{}{"attr2": "value2"})
+}
+
+func (s *interfaceManagerSuite) TestRefreshConnectionsStaticAttrsKeepsConnectionWithoutDeviceContext(c *C) {
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.MockSnapDecl(c, "producer", "one-publisher", nil)
+	s.mockSnap(c, producerYaml)
+	s.MockSnapDecl(c, "consumer", "one-publisher", map[string]interface{}{
+		"format": "3",
+		"plugs": map[string]interface{}{
+			"test": map[string]interface{}{
+				"allow-connection": map[string]interface{}{
+					"on-store": []interface{}{"my-store"},
+				},
+			},
+		},
+	})
+	s.mockSnap(c, consumerYaml)
+	mgr := s.manager(c)
+	repo := mgr.Repository()
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	original := map[string]interface{}{
+		"consumer:plug producer:slot": map[string]interface{}{
+			"interface":   "test",
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": "value2"},
+		},
+	}
+	s.state.Set("conns", original)
+
+	// without a device context the on-store constraint cannot be
+	// evaluated; the connection must be left exactly as found rather than
+	// being marked undesired because of a transient gap.
+	c.Assert(ifacestate.RefreshConnectionsStaticAttrs(s.state, repo, nil), IsNil)
+
+	var conns map[string]interface{}
+	c.Assert(s.state.Get("conns", &conns), IsNil)
+	c.Assert(conns, DeepEquals, original)
+}
+
+// TestRefreshConnectionsStaticAttrsPreservingStaleUpdatesOnPolicyAllow is the
+// happy path for the keep-but-mark-stale variant: the new attrs still
+// satisfy policy, so they are adopted and the connection is not (or is no
+// longer) marked stale.
+func (s *interfaceManagerSuite) TestRefreshConnectionsStaticAttrsPreservingStaleUpdatesOnPolicyAllow(c *C) {
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.mockSnap(c, consumerYaml)
+	producer := s.mockSnap(c, producerYaml)
+	mgr := s.manager(c)
+	repo := mgr.Repository()
+
+	s.state.Lock()
+	defer s.state.Unlock()
+	connRef := &interfaces.ConnRef{
+		PlugRef: interfaces.PlugRef{Snap: "consumer", Name: "plug"},
+		SlotRef: interfaces.SlotRef{Snap: "producer", Name: "slot"},
+	}
+	s.state.Set("conns", map[string]interface{}{
+		connRef.ID(): map[string]interface{}{
+			"interface":   "test",
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": "value2"},
+		},
+	})
+	c.Assert(ifacestate.MarkConnectionStaleAttrs(s.state, connRef, true), IsNil)
+
+	refreshedProducer := producer
+	refreshedProducer.Slots["slot"].Attrs = map[string]interface{}{"attr2": "value2-widened"}
+	c.Assert(repo.RemoveSlot(producer.InstanceName(), "slot"), IsNil)
+	c.Assert(repo.AddSlot(refreshedProducer.Slots["slot"]), IsNil)
+
+	c.Assert(ifacestate.RefreshConnectionsStaticAttrsPreservingStale(s.state, repo, nil), IsNil)
+
+	conns, err := ifacestate.GetConns(s.state)
+	c.Assert(err, IsNil)
+	_, _, slotStatic, _, ok := ifacestate.GetConnStateAttrs(conns, connRef.ID())
+	c.Assert(ok, Equals, true)
+	c.Check(slotStatic, DeepEquals, map[string]interface{}{"attr2": "value2-widened"})
+
+	stale, err := ifacestate.IsConnectionStaleAttrs(s.state, connRef)
+	c.Assert(err, IsNil)
+	c.Check(stale, Equals, false)
+}
+
+// TestRefreshConnectionsStaticAttrsPreservingStaleRegeneratesSecurityOfAffectedSnaps
+// is the keep-but-mark-stale counterpart of
+// TestRefreshConnectionsStaticAttrsRegeneratesSecurityOfAffectedSnaps: an
+// attribute that is actually adopted must still reach the security backends,
+// even though this variant never disconnects anything.
+func (s *interfaceManagerSuite) TestRefreshConnectionsStaticAttrsPreservingStaleRegeneratesSecurityOfAffectedSnaps(c *C) {
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.mockSnap(c, consumerYaml)
+	producer := s.mockSnap(c, producerYaml)
+	mgr := s.manager(c)
+	repo := mgr.Repository()
+
+	var setupFor []string
+	restoreSetup := ifacestate.MockSetupAffectedSnapsSecurity(func(st *state.State, instanceNames []string) error {
+		setupFor = instanceNames
+		return nil
+	})
+	defer restoreSetup()
+
+	s.state.Lock()
+	defer s.state.Unlock()
+	connRef := &interfaces.ConnRef{
+		PlugRef: interfaces.PlugRef{Snap: "consumer", Name: "plug"},
+		SlotRef: interfaces.SlotRef{Snap: "producer", Name: "slot"},
+	}
+	s.state.Set("conns", map[string]interface{}{
+		connRef.ID(): map[string]interface{}{
+			"interface":   "test",
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": "value2"},
+		},
+	})
+
+	refreshedProducer := producer
+	refreshedProducer.Slots["slot"].Attrs = map[string]interface{}{"attr2": "value2-widened"}
+	c.Assert(repo.RemoveSlot(producer.InstanceName(), "slot"), IsNil)
+	c.Assert(repo.AddSlot(refreshedProducer.Slots["slot"]), IsNil)
+
+	c.Assert(ifacestate.RefreshConnectionsStaticAttrsPreservingStale(s.state, repo, nil), IsNil)
+	c.Check(setupFor, DeepEquals, []string{"consumer", "producer"})
+}
+
+// TestRefreshConnectionsStaticAttrsPreservingStaleKeepsConnectionOnPolicyDeny
+// covers the behavior that sets this variant apart from
+// RefreshConnectionsStaticAttrs: a connection the policy no longer allows
+// with its current attrs is neither disconnected nor marked undesired, it
+// is simply flagged stale and left exactly as stored.
+func (s *interfaceManagerSuite) TestRefreshConnectionsStaticAttrsPreservingStaleKeepsConnectionOnPolicyDeny(c *C) {
+	restore := assertstest.MockBuiltinBaseDeclaration([]byte(`
+type: base-declaration
+authority-id: canonical
+series: 16
+slots:
+  test:
+    allow-connection: false
+`))
+	defer restore()
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.mockSnap(c, consumerYaml)
+	s.mockSnap(c, producerYaml)
+	mgr := s.manager(c)
+	repo := mgr.Repository()
+
+	s.state.Lock()
+	defer s.state.Unlock()
+	connRef := &interfaces.ConnRef{
+		PlugRef: interfaces.PlugRef{Snap: "consumer", Name: "plug"},
+		SlotRef: interfaces.SlotRef{Snap: "producer", Name: "slot"},
+	}
+	original := map[string]interface{}{
+		connRef.ID(): map[string]interface{}{
+			"interface":   "test",
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": "value2"},
+		},
+	}
+	s.state.Set("conns", original)
+
+	c.Assert(ifacestate.RefreshConnectionsStaticAttrsPreservingStale(s.state, repo, &snapstatetest.TrivialDeviceContext{}), IsNil)
+
+	var conns map[string]interface{}
+	c.Assert(s.state.Get("conns", &conns), IsNil)
+	c.Check(conns, DeepEquals, original)
+	c.Check(repo.Interfaces().Connections, HasLen, 1)
+
+	stale, err := ifacestate.IsConnectionStaleAttrs(s.state, connRef)
+	c.Assert(err, IsNil)
+	c.Check(stale, Equals, true)
+}
+
+// TestRefreshConnectionsStaticAttrsPreservingStaleSkipsUndesiredAndHotplugGone
+// checks that undesired and hotplug-gone entries are left alone: they are
+// not currently active connections, so there is no fresh policy decision to
+// make for them.
+func (s *interfaceManagerSuite) TestRefreshConnectionsStaticAttrsPreservingStaleSkipsUndesiredAndHotplugGone(c *C) {
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.mockSnap(c, consumerYaml)
+	s.mockSnap(c, producerYaml)
+	mgr := s.manager(c)
+	repo := mgr.Repository()
+
+	s.state.Lock()
+	defer s.state.Unlock()
+	original := map[string]interface{}{
+		"consumer:plug producer:slot": map[string]interface{}{
+			"interface":   "test",
+			"undesired":   true,
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": "value2"},
+		},
+		"consumer:otherplug core:gone-slot": map[string]interface{}{
+			"interface":    "test2",
+			"hotplug-gone": true,
+			"hotplug-key":  "1234",
+		},
+	}
+	s.state.Set("conns", original)
+
+	c.Assert(ifacestate.RefreshConnectionsStaticAttrsPreservingStale(s.state, repo, nil), IsNil)
+
+	var conns map[string]interface{}
+	c.Assert(s.state.Get("conns", &conns), IsNil)
+	c.Check(conns, DeepEquals, original)
+}
+
+// TestRefreshConnectionsStaticAttrsPreservingStalePropagatesSlotAttrChange
+// covers a shared-memory-style interface: a slot's "write" path list changes
+// across a producer refresh (the producer here stands in for the backing
+// snap; a real shared-memory slot's "private" attribute works the same
+// way), and the new list must reach the connection's stored slot-static so
+// the plug's security profile picks it up on the next setup-profiles run.
+func (s *interfaceManagerSuite) TestRefreshConnectionsStaticAttrsPreservingStalePropagatesSlotAttrChange(c *C) {
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.mockSnap(c, consumerYaml)
+	producer := s.mockSnap(c, producerYaml)
+	mgr := s.manager(c)
+	repo := mgr.Repository()
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	s.state.Set("conns", map[string]interface{}{
+		"consumer:plug producer:slot": map[string]interface{}{
+			"interface":   "test",
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": []interface{}{"/old/write/path"}},
+		},
+	})
+
+	refreshedProducer := producer
+	refreshedProducer.Slots["slot"].Attrs = map[string]interface{}{"attr2": []interface{}{"/old/write/path", "/new/write/path"}}
+	c.Assert(repo.RemoveSlot(producer.InstanceName(), "slot"), IsNil)
+	c.Assert(repo.AddSlot(refreshedProducer.Slots["slot"]), IsNil)
+
+	c.Assert(ifacestate.RefreshConnectionsStaticAttrsPreservingStale(s.state, repo, nil), IsNil)
+
+	conns, err := ifacestate.GetConns(s.state)
+	c.Assert(err, IsNil)
+	_, _, slotStatic, _, ok := ifacestate.GetConnStateAttrs(conns, "consumer:plug producer:slot")
+	c.Assert(ok, Equals, true)
+	c.Check(slotStatic, DeepEquals, map[string]interface{}{"attr2": []interface{}{"/old/write/path", "/new/write/path"}})
+}
+
+// TestRefreshConnectionsStaticAttrsPreservingStaleKeepsOldAttrsWhenAutoConnectNoLongerPermits
+// is the "auto": true counterpart of
+// TestRefreshConnectionsStaticAttrsPreservingStaleKeepsConnectionOnPolicyDeny:
+// the auto-connect policy no longer permits the pair with its current
+// attrs, so the old, still-policy-satisfying attrs must be left in place
+// rather than adopting values nobody would approve of.
+func (s *interfaceManagerSuite) TestRefreshConnectionsStaticAttrsPreservingStaleKeepsOldAttrsWhenAutoConnectNoLongerPermits(c *C) {
+	restore := assertstest.MockBuiltinBaseDeclaration([]byte(`
+type: base-declaration
+authority-id: canonical
+series: 16
+slots:
+  test:
+    allow-auto-connection: false
+`))
+	defer restore()
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.mockSnap(c, consumerYaml)
+	s.mockSnap(c, producerYaml)
+	mgr := s.manager(c)
+	repo := mgr.Repository()
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	original := map[string]interface{}{
+		"consumer:plug producer:slot": map[string]interface{}{
+			"interface":   "test",
+			"auto":        true,
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": []interface{}{"/old/write/path"}},
+		},
+	}
+	s.state.Set("conns", original)
+
+	c.Assert(ifacestate.RefreshConnectionsStaticAttrsPreservingStale(s.state, repo, &snapstatetest.TrivialDeviceContext{}), IsNil)
+
+	var conns map[string]interface{}
+	c.Assert(s.state.Get("conns", &conns), IsNil)
+	c.Check(conns, DeepEquals, original)
+	c.Check(repo.Interfaces().Connections, HasLen, 1)
+}
+
+// consumerUpdatedAttrYaml is consumerYaml with "plug"'s attr1 changed, as if
+// a newer revision of the consumer snap widened/narrowed it.
+var consumerUpdatedAttrYaml = `
+name: consumer
+version: 2
+plugs:
+ plug:
+  interface: test
+  attr1: value1-updated
+ otherplug:
+  interface: test2
+hooks:
+ prepare-plug-plug:
+ unprepare-plug-plug:
+ connect-plug-plug:
+ disconnect-plug-plug:
+ prepare-plug-otherplug:
+ unprepare-plug-otherplug:
+ connect-plug-otherplug:
+ disconnect-plug-otherplug:
+`
+
+// TestRefreshConnectionsStaticAttrsForTaskUpdatesOnSetupProfilesReload mirrors
+// testDoSetupSnapSecurityReloadsConnectionsWhenInvokedOn, but the reloaded
+// snap revision has changed its plug's static attrs, and the refresh is
+// driven through the task-aware entry point setup-profiles is meant to use.
+func (s *interfaceManagerSuite) TestRefreshConnectionsStaticAttrsForTaskUpdatesOnSetupProfilesReload(c *C) {
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"}, &ifacetest.TestInterface{InterfaceName: "test2"})
+	s.mockSnap(c, consumerYaml)
+	s.mockSnap(c, producerYaml)
+
+	s.state.Lock()
+	s.state.Set("conns", map[string]interface{}{
+		"consumer:plug producer:slot": map[string]interface{}{
+			"interface":   "test",
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": "value2"},
+		},
+	})
+	s.state.Unlock()
+
+	mgr := s.manager(c)
+	repo := mgr.Repository()
+
+	newConsumer := s.mockUpdatedSnap(c, consumerUpdatedAttrYaml, 2)
+	c.Assert(repo.RemovePlug(newConsumer.InstanceName(), "plug"), IsNil)
+	c.Assert(repo.AddPlug(newConsumer.Plugs["plug"]), IsNil)
+
+	change := s.addSetupSnapSecurityChange(c, &snapstate.SnapSetup{
+		SideInfo: &snap.SideInfo{RealName: newConsumer.SnapName(), Revision: newConsumer.Revision},
+	})
+	s.settle(c)
+
+	s.state.Lock()
+	defer s.state.Unlock()
+	c.Check(change.Status(), Equals, state.DoneStatus)
+
+	task := change.Tasks()[0]
+	c.Assert(ifacestate.RefreshConnectionsStaticAttrsForTask(task, repo, nil), IsNil)
+	c.Check(task.Log(), HasLen, 0)
+
+	conns, err := ifacestate.GetConns(s.state)
+	c.Assert(err, IsNil)
+	plugStatic, _, _, _, ok := ifacestate.GetConnStateAttrs(conns, "consumer:plug producer:slot")
+	c.Assert(ok, Equals, true)
+	c.Check(plugStatic, DeepEquals, map[string]interface{}{"attr1": "value1-updated"})
+}
+
+// TestRefreshConnectionsStaticAttrsForTaskLogsWarningWhenPolicyDenies is the
+// negative case: the updated attrs would still reload fine, but a tightened
+// base declaration means the connection policy no longer allows the pair at
+// all, so the old attrs must be kept and a warning logged on the task.
+func (s *interfaceManagerSuite) TestRefreshConnectionsStaticAttrsForTaskLogsWarningWhenPolicyDenies(c *C) {
+	restore := assertstest.MockBuiltinBaseDeclaration([]byte(`
+type: base-declaration
+authority-id: canonical
+series: 16
+slots:
+  test:
+    allow-connection: false
+`))
+	defer restore()
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"}, &ifacetest.TestInterface{InterfaceName: "test2"})
+	s.mockSnap(c, consumerYaml)
+	s.mockSnap(c, producerYaml)
+
+	s.state.Lock()
+	s.state.Set("conns", map[string]interface{}{
+		"consumer:plug producer:slot": map[string]interface{}{
+			"interface":   "test",
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": "value2"},
+		},
+	})
+	s.state.Unlock()
+
+	mgr := s.manager(c)
+	repo := mgr.Repository()
+
+	newConsumer := s.mockUpdatedSnap(c, consumerUpdatedAttrYaml, 2)
+	c.Assert(repo.RemovePlug(newConsumer.InstanceName(), "plug"), IsNil)
+	c.Assert(repo.AddPlug(newConsumer.Plugs["plug"]), IsNil)
+
+	change := s.addSetupSnapSecurityChange(c, &snapstate.SnapSetup{
+		SideInfo: &snap.SideInfo{RealName: newConsumer.SnapName(), Revision: newConsumer.Revision},
+	})
+	s.settle(c)
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	task := change.Tasks()[0]
+	c.Assert(ifacestate.RefreshConnectionsStaticAttrsForTask(task, repo, &snapstatetest.TrivialDeviceContext{}), IsNil)
+	c.Check(task.Log(), HasLen, 1)
+	c.Check(task.Log()[0], testutil.Contains, "no longer allowed by policy")
+
+	conns, err := ifacestate.GetConns(s.state)
+	c.Assert(err, IsNil)
+	plugStatic, _, _, _, ok := ifacestate.GetConnStateAttrs(conns, "consumer:plug producer:slot")
+	c.Assert(ok, Equals, true)
+	c.Check(plugStatic, DeepEquals, map[string]interface{}{"attr1": "value1"})
+}
+
+// TestRefreshConnectionsStaticAttrsForSnapOnlyTouchesGivenSnap is the
+// setup-profiles scoped variant of
+// TestRefreshConnectionsStaticAttrsForTaskUpdatesOnSetupProfilesReload: a
+// second, unrelated connection ("consumer2:plug producer:slot") already has
+// attrs that drifted from what the current policy would derive, but since
+// neither of its sides is the snap being refreshed, RefreshConnectionsStaticAttrsForSnap
+// must leave it exactly as stored while still fixing up "consumer"'s.
+func (s *interfaceManagerSuite) TestRefreshConnectionsStaticAttrsForSnapOnlyTouchesGivenSnap(c *C) {
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"}, &ifacetest.TestInterface{InterfaceName: "test2"})
+	s.mockSnap(c, consumerYaml)
+	s.mockSnap(c, consumer2Yaml)
+	s.mockSnap(c, producerYaml)
+
+	s.state.Lock()
+	s.state.Set("conns", map[string]interface{}{
+		"consumer:plug producer:slot": map[string]interface{}{
+			"interface":   "test",
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": "value2"},
+		},
+		"consumer2:plug producer:slot": map[string]interface{}{
+			"interface":   "test",
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": "stale-value"},
+		},
+	})
+	s.state.Unlock()
+
+	mgr := s.manager(c)
+	repo := mgr.Repository()
+
+	newConsumer := s.mockUpdatedSnap(c, consumerUpdatedAttrYaml, 2)
+	c.Assert(repo.RemovePlug(newConsumer.InstanceName(), "plug"), IsNil)
+	c.Assert(repo.AddPlug(newConsumer.Plugs["plug"]), IsNil)
+
+	change := s.addSetupSnapSecurityChange(c, &snapstate.SnapSetup{
+		SideInfo: &snap.SideInfo{RealName: newConsumer.SnapName(), Revision: newConsumer.Revision},
+	})
+	s.settle(c)
+
+	s.state.Lock()
+	defer s.state.Unlock()
+	c.Check(change.Status(), Equals, state.DoneStatus)
+
+	task := change.Tasks()[0]
+	c.Assert(ifacestate.RefreshConnectionsStaticAttrsForSnap(task, "consumer", repo, nil), IsNil)
+	c.Check(task.Log(), HasLen, 0)
+
+	conns, err := ifacestate.GetConns(s.state)
+	c.Assert(err, IsNil)
+
+	plugStatic, _, _, _, ok := ifacestate.GetConnStateAttrs(conns, "consumer:plug producer:slot")
+	c.Assert(ok, Equals, true)
+	c.Check(plugStatic, DeepEquals, map[string]interface{}{"attr1": "value1-updated"})
+
+	_, _, slotStatic, _, ok := ifacestate.GetConnStateAttrs(conns, "consumer2:plug producer:slot")
+	c.Assert(ok, Equals, true)
+	c.Check(slotStatic, DeepEquals, map[string]interface{}{"attr2": "stale-value"})
+}
+
+// TestRefreshConnectionsStaticAttrsForSnapRegeneratesSecurityOfAffectedSnaps
+// is the single-snap-scoped counterpart of
+// TestRefreshConnectionsStaticAttrsRegeneratesSecurityOfAffectedSnaps: a
+// connection updated by the refresh above must still reach the security
+// backends, same as the all-connections variant.
+func (s *interfaceManagerSuite) TestRefreshConnectionsStaticAttrsForSnapRegeneratesSecurityOfAffectedSnaps(c *C) {
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.mockSnap(c, consumerYaml)
+	s.mockSnap(c, producerYaml)
+
+	s.state.Lock()
+	s.state.Set("conns", map[string]interface{}{
+		"consumer:plug producer:slot": map[string]interface{}{
+			"interface":   "test",
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": "value2"},
+		},
+	})
+	s.state.Unlock()
+
+	mgr := s.manager(c)
+	repo := mgr.Repository()
+
+	newConsumer := s.mockUpdatedSnap(c, consumerUpdatedAttrYaml, 2)
+	c.Assert(repo.RemovePlug(newConsumer.InstanceName(), "plug"), IsNil)
+	c.Assert(repo.AddPlug(newConsumer.Plugs["plug"]), IsNil)
+
+	change := s.addSetupSnapSecurityChange(c, &snapstate.SnapSetup{
+		SideInfo: &snap.SideInfo{RealName: newConsumer.SnapName(), Revision: newConsumer.Revision},
+	})
+	s.settle(c)
+
+	s.state.Lock()
+	defer s.state.Unlock()
+	c.Check(change.Status(), Equals, state.DoneStatus)
+
+	var setupFor []string
+	restoreSetup := ifacestate.MockSetupAffectedSnapsSecurity(func(st *state.State, instanceNames []string) error {
+		setupFor = instanceNames
+		return nil
+	})
+	defer restoreSetup()
+
+	task := change.Tasks()[0]
+	c.Assert(ifacestate.RefreshConnectionsStaticAttrsForSnap(task, "consumer", repo, nil), IsNil)
+	c.Check(setupFor, DeepEquals, []string{"consumer", "producer"})
+}
+
+// TestRefreshConnectionsStaticAttrsForSnapDisconnectsOnlyGivenSnapOnPolicyDeny
+// mirrors TestRefreshConnectionsStaticAttrsForTaskLogsWarningWhenPolicyDenies,
+// scoped to a single snap: a tightened base declaration would forbid every
+// "test" connection, but only the one involving the refreshed snap may be
+// touched.
+func (s *interfaceManagerSuite) TestRefreshConnectionsStaticAttrsForSnapDisconnectsOnlyGivenSnapOnPolicyDeny(c *C) {
+	restore := assertstest.MockBuiltinBaseDeclaration([]byte(`
+type: base-declaration
+authority-id: canonical
+series: 16
+slots:
+  test:
+    allow-connection: false
+`))
+	defer restore()
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"}, &ifacetest.TestInterface{InterfaceName: "test2"})
+	s.mockSnap(c, consumerYaml)
+	s.mockSnap(c, consumer2Yaml)
+	s.mockSnap(c, producerYaml)
+
+	s.state.Lock()
+	s.state.Set("conns", map[string]interface{}{
+		"consumer:plug producer:slot": map[string]interface{}{
+			"interface":   "test",
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": "value2"},
+		},
+		"consumer2:plug producer:slot": map[string]interface{}{
+			"interface":   "test",
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": "value2"},
+		},
+	})
+	s.state.Unlock()
+
+	mgr := s.manager(c)
+	repo := mgr.Repository()
+
+	newConsumer := s.mockUpdatedSnap(c, consumerUpdatedAttrYaml, 2)
+	c.Assert(repo.RemovePlug(newConsumer.InstanceName(), "plug"), IsNil)
+	c.Assert(repo.AddPlug(newConsumer.Plugs["plug"]), IsNil)
+
+	change := s.addSetupSnapSecurityChange(c, &snapstate.SnapSetup{
+		SideInfo: &snap.SideInfo{RealName: newConsumer.SnapName(), Revision: newConsumer.Revision},
+	})
+	s.settle(c)
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	task := change.Tasks()[0]
+	c.Assert(ifacestate.RefreshConnectionsStaticAttrsForSnap(task, "consumer", repo, &snapstatetest.TrivialDeviceContext{}), IsNil)
+	c.Check(task.Log(), HasLen, 1)
+	c.Check(task.Log()[0], testutil.Contains, "no longer allowed by policy")
+
+	conns, err := ifacestate.GetConns(s.state)
+	c.Assert(err, IsNil)
+
+	cstate, ok := conns["consumer:plug producer:slot"].(map[string]interface{})
+	c.Assert(ok, Equals, true)
+	c.Check(cstate["undesired"], Equals, true)
+
+	cstate2, ok := conns["consumer2:plug producer:slot"].(map[string]interface{})
+	c.Assert(ok, Equals, true)
+	c.Check(cstate2["undesired"], Not(Equals), true)
+}
+
+// deviceCtxWithModel builds the minimal snapstatetest.DeviceContext that
+// CheckAutoConnect needs to evaluate an on-store device-scope constraint,
+// without going through a change or task.
+func (s *interfaceManagerSuite) deviceCtxWithModel(c *C, store string) snapstate.DeviceContext {
+	headers := map[string]interface{}{
+		"series":       "16",
+		"brand-id":     "my-brand",
+		"model":        "my-model",
+		"gadget":       "gadget",
+		"kernel":       "krnl",
+		"architecture": "amd64",
+		"timestamp":    time.Now().Format(time.RFC3339),
+	}
+	if store != "" {
+		headers["store"] = store
+	}
+	a, err := s.brandSigning.Sign(asserts.ModelType, headers, nil, "")
+	c.Assert(err, IsNil)
+	return &snapstatetest.DeviceContext{DeviceModel: a.(*asserts.Model)}
+}
+
+// deviceContextWithSerial wraps snapstatetest.DeviceContext with a Serial()
+// accessor so on-serial constraints (which snapstate.DeviceContext itself
+// has no notion of) can be exercised in tests.
+type deviceContextWithSerial struct {
+	snapstate.DeviceContext
+	serial string
+}
+
+func (d *deviceContextWithSerial) Serial() string { return d.serial }
+
+// TestDeviceScopeConstraintsMatch* exercise DeviceScopeConstraintsMatch
+// directly against a DeviceScopeConstraints built by hand, since - as
+// device_scope_match.go's doc comment explains - the asserts and
+// interfaces/policy packages that would parse on-brand/on-model/on-serial
+// out of a real base-declaration/snap-declaration rule and call this
+// helper are not present in this tree. They cannot mirror a
+// TestCheckInterfacesDeviceScopeRightStore-style test driven by a real
+// rule through CheckInterfaces until that wiring lands outside this
+// package.
+func (s *interfaceManagerSuite) TestDeviceScopeConstraintsMatchBrandAndModel(c *C) {
+	deviceCtx := s.deviceCtxWithModel(c, "")
+
+	ok, err := ifacestate.DeviceScopeConstraintsMatch(deviceCtx, ifacestate.DeviceScopeConstraints{})
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, true)
+
+	ok, err = ifacestate.DeviceScopeConstraintsMatch(deviceCtx, ifacestate.DeviceScopeConstraints{OnBrand: []string{"my-brand"}})
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, true)
+
+	ok, err = ifacestate.DeviceScopeConstraintsMatch(deviceCtx, ifacestate.DeviceScopeConstraints{OnBrand: []string{"other-brand"}})
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, false)
+
+	ok, err = ifacestate.DeviceScopeConstraintsMatch(deviceCtx, ifacestate.DeviceScopeConstraints{OnModel: []string{"my-brand/my-model"}})
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, true)
+
+	ok, err = ifacestate.DeviceScopeConstraintsMatch(deviceCtx, ifacestate.DeviceScopeConstraints{OnModel: []string{"my-brand/other-model"}})
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, false)
+}
+
+func (s *interfaceManagerSuite) TestDeviceScopeConstraintsMatchNoModel(c *C) {
+	ok, err := ifacestate.DeviceScopeConstraintsMatch(nil, ifacestate.DeviceScopeConstraints{OnBrand: []string{"my-brand"}})
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, false)
+
+	// an empty constraint set never needs a model to be satisfied
+	ok, err = ifacestate.DeviceScopeConstraintsMatch(nil, ifacestate.DeviceScopeConstraints{})
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, true)
+}
+
+func (s *interfaceManagerSuite) TestDeviceScopeConstraintsMatchSerialGlob(c *C) {
+	deviceCtx := &deviceContextWithSerial{DeviceContext: s.deviceCtxWithModel(c, ""), serial: "1234-abcd"}
+
+	ok, err := ifacestate.DeviceScopeConstraintsMatch(deviceCtx, ifacestate.DeviceScopeConstraints{OnSerial: []string{"1234*"}})
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, true)
+
+	ok, err = ifacestate.DeviceScopeConstraintsMatch(deviceCtx, ifacestate.DeviceScopeConstraints{OnSerial: []string{"5678*"}})
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, false)
+
+	// a device context that cannot report a serial cannot satisfy an
+	// on-serial constraint, even if the model otherwise matches everything
+	// else.
+	ok, err = ifacestate.DeviceScopeConstraintsMatch(s.deviceCtxWithModel(c, ""), ifacestate.DeviceScopeConstraints{OnSerial: []string{"1234*"}})
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, false)
+}
+
+// TestCheckDeviceScopeConstraintsWrapsMatch checks that
+// CheckDeviceScopeConstraints turns a DeviceScopeConstraintsMatch false
+// into a non-nil error, the same error-returning shape
+// CheckAutoconnectCandidate and checkConnectCandidate use elsewhere in this
+// package.
+func (s *interfaceManagerSuite) TestCheckDeviceScopeConstraintsWrapsMatch(c *C) {
+	deviceCtx := s.deviceCtxWithModel(c, "")
+
+	c.Check(ifacestate.CheckDeviceScopeConstraints(deviceCtx, ifacestate.DeviceScopeConstraints{OnBrand: []string{"my-brand"}}), IsNil)
+
+	err := ifacestate.CheckDeviceScopeConstraints(deviceCtx, ifacestate.DeviceScopeConstraints{OnBrand: []string{"other-brand"}})
+	c.Assert(err, NotNil)
+}
+
+func (s *interfaceManagerSuite) TestCheckAutoConnectOnStoreBranches(c *C) {
+	restore := assertstest.MockBuiltinBaseDeclaration([]byte(`
+type: base-declaration
+authority-id: canonical
+series: 16
+slots:
+  test:
+    allow-auto-connection:
+      plug-publisher-id:
+        - $SLOT_PUBLISHER_ID
+`))
+	defer restore()
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.MockSnapDecl(c, "producer", "one-publisher", nil)
+	s.mockSnap(c, producerYaml)
+	s.MockSnapDecl(c, "consumer", "one-publisher", map[string]interface{}{
+		"format": "3",
+		"plugs": map[string]interface{}{
+			"test": map[string]interface{}{
+				"allow-auto-connection": map[string]interface{}{
+					"on-store": []interface{}{"my-store"},
+				},
+			},
+		},
+	})
+	consumer := s.mockSnap(c, consumerYaml)
+	producer := s.mockSnap(c, producerYaml)
+	mgr := s.manager(c)
+	_ = mgr.Repository()
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	plug := consumer.Plugs["plug"]
+	slot := producer.Slots["slot"]
+
+	allowed, err := ifacestate.CheckAutoConnect(s.state, plug, slot, s.deviceCtxWithModel(c, "other-store"))
+	c.Assert(err, IsNil)
+	c.Check(allowed, Equals, false)
+
+	allowed, err = ifacestate.CheckAutoConnect(s.state, plug, slot, s.deviceCtxWithModel(c, "my-store"))
+	c.Assert(err, IsNil)
+	c.Check(allowed, Equals, true)
+}
+
+func (s *interfaceManagerSuite) TestCheckAutoConnectFriendlyStoreBranch(c *C) {
+	restore := assertstest.MockBuiltinBaseDeclaration([]byte(`
+type: base-declaration
+authority-id: canonical
+series: 16
+slots:
+  test:
+    allow-auto-connection:
+      plug-publisher-id:
+        - $SLOT_PUBLISHER_ID
+`))
+	defer restore()
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.MockSnapDecl(c, "producer", "one-publisher", nil)
+	s.mockSnap(c, producerYaml)
+	s.MockSnapDecl(c, "consumer", "one-publisher", map[string]interface{}{
+		"format": "3",
+		"plugs": map[string]interface{}{
+			"test": map[string]interface{}{
+				"allow-auto-connection": map[string]interface{}{
+					"on-store": []interface{}{"my-store"},
+				},
+			},
+		},
+	})
+	consumer := s.mockSnap(c, consumerYaml)
+	producer := s.mockSnap(c, producerYaml)
+	mgr := s.manager(c)
+	_ = mgr.Repository()
+
+	s.MockStore(c, s.state, "my-substore", map[string]interface{}{
+		"friendly-stores": []interface{}{"my-store"},
+	})
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	plug := consumer.Plugs["plug"]
+	slot := producer.Slots["slot"]
+
+	allowed, err := ifacestate.CheckAutoConnect(s.state, plug, slot, s.deviceCtxWithModel(c, "my-substore"))
+	c.Assert(err, IsNil)
+	c.Check(allowed, Equals, true)
+}
+
+func (s *interfaceManagerSuite) mockDeviceScopeDeclaredSnaps(c *C) {
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.MockSnapDecl(c, "producer", "one-publisher", nil)
+	s.mockSnap(c, producerYaml)
+	s.MockSnapDecl(c, "consumer", "one-publisher", map[string]interface{}{
+		"format": "3",
+		"plugs": map[string]interface{}{
+			"test": map[string]interface{}{
+				"allow-auto-connection": map[string]interface{}{
+					"on-store": []interface{}{"my-store"},
+				},
+			},
+		},
+	})
+	s.mockSnap(c, consumerYaml)
+}
+
+// TestReconcileDeviceScopeConnectsOnRightStore mirrors
+// TestDoSetupSnapSecurityAutoConnectsDeclBasedDeviceScopeWrongStore /
+// ...RightStore, but the store starts wrong and is corrected by a
+// reconciliation pass instead of a fresh install.
+func (s *interfaceManagerSuite) TestReconcileDeviceScopeConnectsOnRightStore(c *C) {
+	restore := assertstest.MockBuiltinBaseDeclaration([]byte(`
+type: base-declaration
+authority-id: canonical
+series: 16
+slots:
+  test:
+    allow-auto-connection: false
+`))
+	defer restore()
+	s.mockDeviceScopeDeclaredSnaps(c)
+	mgr := s.manager(c)
+	repo := mgr.Repository()
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	c.Assert(ifacestate.ReconcileDeviceScope(s.state, s.deviceCtxWithModel(c, "other-store")), IsNil)
+	conns, err := ifacestate.GetConns(s.state)
+	c.Assert(err, IsNil)
+	c.Check(conns, HasLen, 0)
+	c.Check(repo.Interfaces().Connections, HasLen, 0)
+
+	c.Assert(ifacestate.ReconcileDeviceScope(s.state, s.deviceCtxWithModel(c, "my-store")), IsNil)
+	conns, err = ifacestate.GetConns(s.state)
+	c.Assert(err, IsNil)
+	cstate, ok := conns["consumer:plug producer:slot"].(map[string]interface{})
+	c.Assert(ok, Equals, true)
+	c.Check(cstate["auto"], Equals, true)
+	c.Check(repo.Interfaces().Connections, DeepEquals, []*interfaces.ConnRef{
+		{PlugRef: interfaces.PlugRef{Snap: "consumer", Name: "plug"}, SlotRef: interfaces.SlotRef{Snap: "producer", Name: "slot"}},
+	})
+}
+
+// TestReconcileDeviceScopeDisconnectsOnTightenedStore is the inverse:
+// reconciliation must remove an existing auto-connection once the device
+// scope no longer permits it.
+func (s *interfaceManagerSuite) TestReconcileDeviceScopeDisconnectsOnTightenedStore(c *C) {
+	restore := assertstest.MockBuiltinBaseDeclaration([]byte(`
+type: base-declaration
+authority-id: canonical
+series: 16
+slots:
+  test:
+    allow-auto-connection: false
+`))
+	defer restore()
+	s.mockDeviceScopeDeclaredSnaps(c)
+	mgr := s.manager(c)
+	repo := mgr.Repository()
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	c.Assert(ifacestate.ReconcileDeviceScope(s.state, s.deviceCtxWithModel(c, "my-store")), IsNil)
+	conns, err := ifacestate.GetConns(s.state)
+	c.Assert(err, IsNil)
+	c.Check(conns, HasLen, 1)
+	c.Check(repo.Interfaces().Connections, HasLen, 1)
+
+	c.Assert(ifacestate.ReconcileDeviceScope(s.state, s.deviceCtxWithModel(c, "other-store")), IsNil)
+	conns, err = ifacestate.GetConns(s.state)
+	c.Assert(err, IsNil)
+	cstate := conns["consumer:plug producer:slot"].(map[string]interface{})
+	c.Check(cstate["undesired"], Equals, true)
+	c.Check(repo.Interfaces().Connections, HasLen, 0)
+}
+
+// TestReconcileDeviceScopeRegeneratesSecurityOfAffectedSnaps checks that
+// both the disconnect and the connect side of a reconciliation pass
+// trigger SetupAffectedSnapsSecurity for the snaps involved, the same way
+// every other reload/refresh variant in this package does.
+func (s *interfaceManagerSuite) TestReconcileDeviceScopeRegeneratesSecurityOfAffectedSnaps(c *C) {
+	restore := assertstest.MockBuiltinBaseDeclaration([]byte(`
+type: base-declaration
+authority-id: canonical
+series: 16
+slots:
+  test:
+    allow-auto-connection: false
+`))
+	defer restore()
+	s.mockDeviceScopeDeclaredSnaps(c)
+	s.manager(c)
+
+	var setupFor []string
+	restoreSetup := ifacestate.MockSetupAffectedSnapsSecurity(func(st *state.State, instanceNames []string) error {
+		setupFor = instanceNames
+		return nil
+	})
+	defer restoreSetup()
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	c.Assert(ifacestate.ReconcileDeviceScope(s.state, s.deviceCtxWithModel(c, "my-store")), IsNil)
+	c.Check(setupFor, DeepEquals, []string{"consumer", "producer"})
+
+	setupFor = nil
+	c.Assert(ifacestate.ReconcileDeviceScope(s.state, s.deviceCtxWithModel(c, "other-store")), IsNil)
+	c.Check(setupFor, DeepEquals, []string{"consumer", "producer"})
+}
+
+func (s *interfaceManagerSuite) TestCheckAutoconnectCandidateWithoutTask(c *C) {
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	consumer := s.mockSnap(c, consumerYaml)
+	producer := s.mockSnap(c, producerYaml)
+	mgr := s.manager(c)
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	plug := consumer.Plugs["plug"]
+	slot := producer.Slots["slot"]
+	_ = mgr.Repository()
+	c.Assert(ifacestate.CheckAutoconnectCandidate(s.state, plug, slot, nil), IsNil)
+}
+
+func (s *interfaceManagerSuite) TestUpdateStaticAttrsForPolicyPicksUpRefreshedSnapYaml(c *C) {
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.mockSnap(c, consumerYaml)
+	producer := s.mockSnap(c, producerYaml)
+	mgr := s.manager(c)
+
+	s.state.Lock()
+	s.state.Set("conns", map[string]interface{}{
+		"consumer:plug producer:slot": map[string]interface{}{
+			"interface":   "test",
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": "value2"},
+		},
+	})
+	s.state.Unlock()
+
+	repo := mgr.Repository()
+
+	// Simulate a refresh that widened the slot's static attrs, as a
+	// shared-memory-style interface would when its "write" list changes.
+	refreshedProducer := producer
+	refreshedProducer.Slots["slot"].Attrs = map[string]interface{}{"attr2": "value2-widened"}
+	c.Assert(repo.RemoveSlot(producer.InstanceName(), "slot"), IsNil)
+	c.Assert(repo.AddSlot(refreshedProducer.Slots["slot"]), IsNil)
+
+	s.state.Lock()
+	defer s.state.Unlock()
+	c.Assert(ifacestate.RefreshConnectionsStaticAttrs(s.state, repo, nil), IsNil)
+
+	conns, err := ifacestate.GetConns(s.state)
+	c.Assert(err, IsNil)
+	_, _, slotStatic, _, ok := ifacestate.GetConnStateAttrs(conns, "consumer:plug producer:slot")
+	c.Assert(ok, Equals, true)
+	c.Check(slotStatic, DeepEquals, map[string]interface{}{"attr2": "value2-widened"})
+}
+
+func (s *interfaceManagerSuite) TestAutoConnectCandidatesWithoutTask(c *C) {
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.mockSnap(c, consumerYaml)
+	s.mockSnap(c, producerYaml)
+	mgr := s.manager(c)
+	_ = mgr
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	candidates, err := ifacestate.AutoConnectCandidates(s.state, "consumer", nil)
+	c.Assert(err, IsNil)
+	c.Assert(candidates, HasLen, 1)
+	c.Check(candidates[0].PlugRef.Snap, Equals, "consumer")
+	c.Check(candidates[0].SlotRef.Snap, Equals, "producer")
+}
+
+func (s *interfaceManagerSuite) TestReloadConnectionsTxnRestoresSnapshotOnFailure(c *C) {
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.mockSnap(c, consumerYaml)
+	s.mockSnap(c, producerYaml)
+	mgr := s.manager(c)
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	original := map[string]interface{}{
+		"consumer:plug producer:slot": map[string]interface{}{
+			"interface":   "test",
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": "value2"},
+		},
+		// malformed identifier: cannot be parsed back into a ConnRef, which
+		// must make the whole reload pass fail rather than silently drop it.
+		"not-a-valid-conn-id": map[string]interface{}{"interface": "test"},
+	}
+	s.state.Set("conns", original)
+
+	err := ifacestate.ReloadConnectionsTxn(s.state, mgr.Repository(), nil)
+	c.Assert(err, NotNil)
+
+	var conns map[string]interface{}
+	c.Assert(s.state.Get("conns", &conns), IsNil)
+	c.Assert(conns, DeepEquals, original)
+}
+
+// TestReloadConnectionsTxnDoesNotMutateRepoOnPlanningFailure checks that a
+// connection whose id cannot be parsed aborts the whole pass before repo
+// is mutated for any other connection - not just before conns is set. A
+// connection that a concurrently planned, unrelated malformed id should
+// still leave untouched would previously have already been disconnected
+// from repo by the time the malformed id was reached and the pass failed,
+// even though the failure left conns (and thus this function's caller)
+// believing nothing happened at all.
+func (s *interfaceManagerSuite) TestReloadConnectionsTxnDoesNotMutateRepoOnPlanningFailure(c *C) {
+	restore := assertstest.MockBuiltinBaseDeclaration([]byte(`
+type: base-declaration
+authority-id: canonical
+series: 16
+slots:
+  test:
+    allow-connection: false
+`))
+	defer restore()
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.mockSnap(c, consumerYaml)
+	s.mockSnap(c, producerYaml)
+	mgr := s.manager(c)
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	original := map[string]interface{}{
+		// the base declaration above now forbids this connection, so a plan
+		// would call repo.Disconnect for it if the pass ran to completion.
+		"consumer:plug producer:slot": map[string]interface{}{
+			"interface":   "test",
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": "value2"},
+		},
+		"not-a-valid-conn-id": map[string]interface{}{"interface": "test"},
+	}
+	s.state.Set("conns", original)
+
+	err := ifacestate.ReloadConnectionsTxn(s.state, mgr.Repository(), &snapstatetest.TrivialDeviceContext{})
+	c.Assert(err, NotNil)
+
+	var conns map[string]interface{}
+	c.Assert(s.state.Get("conns", &conns), IsNil)
+	c.Assert(conns, DeepEquals, original)
+
+	repo := mgr.Repository()
+	c.Check(repo.Interfaces().Connections, DeepEquals, []*interfaces.ConnRef{
+		{PlugRef: interfaces.PlugRef{Snap: "consumer", Name: "plug"}, SlotRef: interfaces.SlotRef{Snap: "producer", Name: "slot"}},
+	})
+}
+
+// TestReloadConnectionsUsesCurrentRepository checks that the manager-start
+// entry point ReloadConnections fetches the repository itself (rather than
+// asking the caller for one) and still goes through the same
+// ReloadConnectionsTxn policy re-evaluation.
+func (s *interfaceManagerSuite) TestReloadConnectionsUsesCurrentRepository(c *C) {
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.mockSnap(c, consumerYaml)
+	s.mockSnap(c, producerYaml)
+	mgr := s.manager(c)
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	s.state.Set("conns", map[string]interface{}{
+		"consumer:plug producer:slot": map[string]interface{}{
+			"interface":   "test",
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": "value2"},
+		},
+	})
+
+	c.Assert(ifacestate.ReloadConnections(s.state, nil), IsNil)
+
+	repo := mgr.Repository()
+	c.Check(repo.Interfaces().Connections, DeepEquals, []*interfaces.ConnRef{
+		{PlugRef: interfaces.PlugRef{Snap: "consumer", Name: "plug"}, SlotRef: interfaces.SlotRef{Snap: "producer", Name: "slot"}},
+	})
+}
+
+// TestReloadConnectionsRefusesNewerConnsSchema checks that ReloadConnections
+// runs MigrateConnsSchema before touching conns at all: state stamped with a
+// "conns-version" newer than this snapd understands (eg. after a downgrade)
+// must abort startup with *ConnsSchemaTooNewError rather than reload
+// connections it might misinterpret.
+func (s *interfaceManagerSuite) TestReloadConnectionsRefusesNewerConnsSchema(c *C) {
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.mockSnap(c, consumerYaml)
+	s.mockSnap(c, producerYaml)
+	s.manager(c)
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	s.state.Set("conns-version", ifacestate.ConnsSchemaVersion()+1)
+	s.state.Set("conns", map[string]interface{}{
+		"consumer:plug producer:slot": map[string]interface{}{"interface": "test"},
+	})
+
+	err := ifacestate.ReloadConnections(s.state, nil)
+	c.Assert(err, FitsTypeOf, &ifacestate.ConnsSchemaTooNewError{})
+}
+
+// TestMigrateConnsSchemaFromV0MatchesCurrentShape constructs conns exactly
+// as pre-versioning snapd wrote it (no "conns-version" key at all, no
+// "connected-at", "hotplug-gone" only present when true - the shape
+// TestHotplugConnect/TestHotplugDisconnect assert against) and checks the
+// migrated result byte-for-byte against what a fresh v2 entry looks like.
+func (s *interfaceManagerSuite) TestMigrateConnsSchemaFromV0MatchesCurrentShape(c *C) {
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	s.state.Set("conns", map[string]interface{}{
+		"consumer:plug producer:slot": map[string]interface{}{
+			"interface":   "test",
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": "value2"},
+		},
+		"consumer:plug core:hotplugslot": map[string]interface{}{
+			"interface":    "test",
+			"hotplug-key":  "1234",
+			"hotplug-gone": true,
+		},
+	})
+
+	c.Assert(ifacestate.MigrateConnsSchema(s.state), IsNil)
+
+	var version int
+	c.Assert(s.state.Get("conns-version", &version), IsNil)
+	c.Check(version, Equals, ifacestate.ConnsSchemaVersion())
+
+	var conns map[string]interface{}
+	c.Assert(s.state.Get("conns", &conns), IsNil)
+	c.Check(conns, DeepEquals, map[string]interface{}{
+		"consumer:plug producer:slot": map[string]interface{}{
+			"interface":    "test",
+			"plug-static":  map[string]interface{}{"attr1": "value1"},
+			"slot-static":  map[string]interface{}{"attr2": "value2"},
+			"connected-at": "",
+			"hotplug-gone": false,
+		},
+		"consumer:plug core:hotplugslot": map[string]interface{}{
+			"interface":    "test",
+			"hotplug-key":  "1234",
+			"hotplug-gone": true,
+			"connected-at": "",
+		},
+	})
+}
+
+// TestMigrateConnsSchemaIsNoopAtCurrentVersion checks that a state already
+// stamped at the current version is left untouched - migrations must not
+// re-run or re-stamp an already up-to-date state.
+func (s *interfaceManagerSuite) TestMigrateConnsSchemaIsNoopAtCurrentVersion(c *C) {
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	original := map[string]interface{}{
+		"consumer:plug producer:slot": map[string]interface{}{
+			"interface":    "test",
+			"connected-at": "2021-01-01T00:00:00Z",
+			"hotplug-gone": false,
+		},
+	}
+	s.state.Set("conns", original)
+	s.state.Set("conns-version", ifacestate.ConnsSchemaVersion())
+
+	c.Assert(ifacestate.MigrateConnsSchema(s.state), IsNil)
+
+	var conns map[string]interface{}
+	c.Assert(s.state.Get("conns", &conns), IsNil)
+	c.Check(conns, DeepEquals, original)
+}
+
+// TestMigrateConnsSchemaRefusesNewerState is the downgrade-protection case:
+// state stamped at a version newer than this snapd understands must be
+// refused with a typed error rather than silently reinterpreted.
+func (s *interfaceManagerSuite) TestMigrateConnsSchemaRefusesNewerState(c *C) {
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	s.state.Set("conns", map[string]interface{}{})
+	s.state.Set("conns-version", ifacestate.ConnsSchemaVersion()+1)
+
+	err := ifacestate.MigrateConnsSchema(s.state)
+	c.Assert(err, FitsTypeOf, &ifacestate.ConnsSchemaTooNewError{})
+	tooNew := err.(*ifacestate.ConnsSchemaTooNewError)
+	c.Check(tooNew.Stored, Equals, ifacestate.ConnsSchemaVersion()+1)
+	c.Check(tooNew.Running, Equals, ifacestate.ConnsSchemaVersion())
+}
+
+// TestMatchingHotplugInterfacesOrsPredicates covers (i): predicates are ORed
+// within and across interfaces - usb-ids is matched through its second
+// predicate even though the device fails its first, and serial-port through
+// its only one.
+func (s *interfaceManagerSuite) TestMatchingHotplugInterfacesOrsPredicates(c *C) {
+	predicates := map[string][]ifacestate.HotplugDeviceMatchPredicate{
+		"serial-port": {{Subsystem: "tty"}},
+		"usb-ids":     {{Subsystem: "usb"}, {Subsystem: "tty", VendorIDGlob: "0123"}},
+	}
+
+	matched := ifacestate.MatchingHotplugInterfaces(predicates, map[string]string{
+		"SUBSYSTEM":    "tty",
+		"ID_VENDOR_ID": "0123",
+	})
+	sort.Strings(matched)
+	c.Check(matched, DeepEquals, []string{"serial-port", "usb-ids"})
+}
+
+// TestMatchingHotplugInterfacesExcludesNonMatchingSubsystem covers (ii): an
+// interface that only declared SUBSYSTEM==tty must not be returned for a
+// block device.
+func (s *interfaceManagerSuite) TestMatchingHotplugInterfacesExcludesNonMatchingSubsystem(c *C) {
+	predicates := map[string][]ifacestate.HotplugDeviceMatchPredicate{
+		"serial-port": {{Subsystem: "tty"}},
+	}
+
+	matched := ifacestate.MatchingHotplugInterfaces(predicates, map[string]string{"SUBSYSTEM": "block"})
+	c.Check(matched, HasLen, 0)
+}
+
+// TestAnyHotplugPredicateWantsEnumerationEmptyFilterMeansFallback covers
+// (iii)'s precondition: with no predicates registered at all (the fallback
+// "matcher not implemented" case) enumeration must still be considered
+// wanted, since EnumerationDone firing exactly once must not depend on any
+// interface having opted into the new matcher.
+func (s *interfaceManagerSuite) TestAnyHotplugPredicateWantsEnumerationEmptyFilterMeansFallback(c *C) {
+	c.Check(ifacestate.AnyHotplugPredicateWantsEnumeration(nil), Equals, true)
+	c.Check(ifacestate.AnyHotplugPredicateWantsEnumeration(map[string][]ifacestate.HotplugDeviceMatchPredicate{
+		"serial-port": nil,
+	}), Equals, true)
+}
+
+func (s *interfaceManagerSuite) TestResolveGadgetDisconnectDirectivesSkipsUnconnected(c *C) {
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	s.state.Set("conns", map[string]interface{}{
+		"consumer:plug producer:slot": map[string]interface{}{"interface": "test"},
+	})
+
+	directives := []ifacestate.GadgetDisconnectDirective{
+		{
+			PlugRef: interfaces.PlugRef{Snap: "consumer", Name: "plug"},
+			SlotRef: interfaces.SlotRef{Snap: "producer", Name: "slot"},
+		},
+		{
+			PlugRef: interfaces.PlugRef{Snap: "other-consumer", Name: "plug"},
+			SlotRef: interfaces.SlotRef{Snap: "other-producer", Name: "slot"},
+		},
+	}
+	toDisconnect, err := ifacestate.ResolveGadgetDisconnectDirectives(s.state, directives)
+	c.Assert(err, IsNil)
+	c.Assert(toDisconnect, HasLen, 1)
+	c.Check(toDisconnect[0].PlugRef, Equals, directives[0].PlugRef)
+	c.Check(toDisconnect[0].SlotRef, Equals, directives[0].SlotRef)
+
+	c.Check(s.log.String(), testutil.Contains, "not connected")
+}
+
+func (s *interfaceManagerSuite) TestOrderGadgetConnectDirectivesRespectsOrderHint(c *C) {
+	first := ifacestate.GadgetConnectDirective{PlugRef: interfaces.PlugRef{Snap: "consumer", Name: "first"}}
+	second := ifacestate.GadgetConnectDirective{PlugRef: interfaces.PlugRef{Snap: "consumer", Name: "second"}}
+	unordered := ifacestate.GadgetConnectDirective{PlugRef: interfaces.PlugRef{Snap: "consumer", Name: "unordered"}}
+
+	// gadget.yaml listed them second, unordered, first, but the order hint
+	// says first must come before second; unordered isn't mentioned, so it
+	// keeps trailing behind the ones that are.
+	directives := []ifacestate.GadgetConnectDirective{second, unordered, first}
+	order := []interfaces.PlugRef{first.PlugRef, second.PlugRef}
+
+	got := ifacestate.OrderGadgetConnectDirectives(directives, order)
+	c.Check(got, DeepEquals, []ifacestate.GadgetConnectDirective{first, second, unordered})
+}
+
+func (s *interfaceManagerSuite) TestOrderGadgetConnectDirectivesNoHintKeepsOriginalOrder(c *C) {
+	directives := []ifacestate.GadgetConnectDirective{
+		{PlugRef: interfaces.PlugRef{Snap: "consumer", Name: "second"}},
+		{PlugRef: interfaces.PlugRef{Snap: "consumer", Name: "first"}},
+	}
+	c.Check(ifacestate.OrderGadgetConnectDirectives(directives, nil), DeepEquals, directives)
+}
+
+// TestOrderGadgetConnectDirectivesKeepsBothDirectivesForSharedPlug covers a
+// plug connected to two different slots: both directives share a ranked
+// plug, so neither must be dropped the way a single-directive-per-rank map
+// would silently drop one of them.
+func (s *interfaceManagerSuite) TestOrderGadgetConnectDirectivesKeepsBothDirectivesForSharedPlug(c *C) {
+	plug := interfaces.PlugRef{Snap: "consumer", Name: "plug"}
+	toFirstSlot := ifacestate.GadgetConnectDirective{PlugRef: plug, SlotRef: interfaces.SlotRef{Snap: "producer", Name: "first-slot"}}
+	toSecondSlot := ifacestate.GadgetConnectDirective{PlugRef: plug, SlotRef: interfaces.SlotRef{Snap: "producer", Name: "second-slot"}}
+	unordered := ifacestate.GadgetConnectDirective{PlugRef: interfaces.PlugRef{Snap: "consumer", Name: "unordered"}}
+
+	directives := []ifacestate.GadgetConnectDirective{unordered, toFirstSlot, toSecondSlot}
+	order := []interfaces.PlugRef{plug}
+
+	got := ifacestate.OrderGadgetConnectDirectives(directives, order)
+	c.Check(got, DeepEquals, []ifacestate.GadgetConnectDirective{toFirstSlot, toSecondSlot, unordered})
+}
+
+// TestRefreshHotplugSlotStaticAttrsUpdatesOnPolicyAllow mirrors
+// TestRefreshConnectionsStaticAttrsUpdatesOnPolicyAllow, but starting from
+// the slot side: the hotplug interface's own attribute derivation changed
+// across a core refresh while the device and its hotplug key stayed the
+// same, so the repository's slot (not a consuming snap's plug) is what
+// carries the fresh attrs the caller is expected to have already applied.
+func (s *interfaceManagerSuite) TestRefreshHotplugSlotStaticAttrsUpdatesOnPolicyAllow(c *C) {
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.mockSnap(c, consumerYaml)
+	coreInfo := s.mockSnap(c, coreSnapYaml)
+	mgr := s.manager(c)
+	repo := mgr.Repository()
+
+	c.Assert(repo.AddSlot(&snap.SlotInfo{
+		Snap:       coreInfo,
+		Name:       "hotplugslot",
+		Interface:  "test",
+		HotplugKey: "1234",
+		Attrs:      map[string]interface{}{"attr2": "value2-updated"},
+	}), IsNil)
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	s.state.Set("conns", map[string]interface{}{
+		"consumer:plug core:hotplugslot": map[string]interface{}{
+			"interface":   "test",
+			"hotplug-key": "1234",
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": "value2"},
+		},
+	})
+
+	c.Assert(ifacestate.RefreshHotplugSlotStaticAttrs(s.state, repo, "test", "1234", nil), IsNil)
+
+	conns, err := ifacestate.GetConns(s.state)
+	c.Assert(err, IsNil)
+	plugStatic, _, slotStatic, _, ok := ifacestate.GetConnStateAttrs(conns, "consumer:plug core:hotplugslot")
+	c.Assert(ok, Equals, true)
+	c.Check(plugStatic, DeepEquals, map[string]interface{}{"attr1": "value1"})
+	c.Check(slotStatic, DeepEquals, map[string]interface{}{"attr2": "value2-updated"})
+}
+
+// TestRefreshHotplugSlotStaticAttrsRegeneratesSecurityOfAffectedSnaps is the
+// hotplug-slot-scoped counterpart of
+// TestRefreshConnectionsStaticAttrsRegeneratesSecurityOfAffectedSnaps: a
+// connection whose slot-static was actually refreshed must still reach the
+// security backends.
+func (s *interfaceManagerSuite) TestRefreshHotplugSlotStaticAttrsRegeneratesSecurityOfAffectedSnaps(c *C) {
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.mockSnap(c, consumerYaml)
+	coreInfo := s.mockSnap(c, coreSnapYaml)
+	mgr := s.manager(c)
+	repo := mgr.Repository()
+
+	c.Assert(repo.AddSlot(&snap.SlotInfo{
+		Snap:       coreInfo,
+		Name:       "hotplugslot",
+		Interface:  "test",
+		HotplugKey: "1234",
+		Attrs:      map[string]interface{}{"attr2": "value2-updated"},
+	}), IsNil)
+
+	var setupFor []string
+	restoreSetup := ifacestate.MockSetupAffectedSnapsSecurity(func(st *state.State, instanceNames []string) error {
+		setupFor = instanceNames
+		return nil
+	})
+	defer restoreSetup()
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	s.state.Set("conns", map[string]interface{}{
+		"consumer:plug core:hotplugslot": map[string]interface{}{
+			"interface":   "test",
+			"hotplug-key": "1234",
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": "value2"},
+		},
+	})
+
+	c.Assert(ifacestate.RefreshHotplugSlotStaticAttrs(s.state, repo, "test", "1234", nil), IsNil)
+	c.Check(setupFor, DeepEquals, []string{"consumer", "core"})
+}
+
+// TestRefreshHotplugSlotStaticAttrsDisconnectsOnPolicyDeny is the negative
+// case: the base declaration tightens and the hotplug connection's policy
+// no longer allows it at all, regardless of what the new attrs are.
+func (s *interfaceManagerSuite) TestRefreshHotplugSlotStaticAttrsDisconnectsOnPolicyDeny(c *C) {
+	restore := assertstest.MockBuiltinBaseDeclaration([]byte(`
+type: base-declaration
+authority-id: canonical
+series: 16
+slots:
+  test:
+    allow-connection: false
+`))
+	defer restore()
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.mockSnap(c, consumerYaml)
+	coreInfo := s.mockSnap(c, coreSnapYaml)
+	mgr := s.manager(c)
+	repo := mgr.Repository()
+
+	c.Assert(repo.AddSlot(&snap.SlotInfo{
+		Snap:       coreInfo,
+		Name:       "hotplugslot",
+		Interface:  "test",
+		HotplugKey: "1234",
+		Attrs:      map[string]interface{}{"attr2": "value2"},
+	}), IsNil)
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	s.state.Set("conns", map[string]interface{}{
+		"consumer:plug core:hotplugslot": map[string]interface{}{
+			"interface":   "test",
+			"hotplug-key": "1234",
+			"plug-static": map[string]interface{}{"attr1": "value1"},
+			"slot-static": map[string]interface{}{"attr2": "value2"},
+		},
+	})
+
+	c.Assert(ifacestate.RefreshHotplugSlotStaticAttrs(s.state, repo, "test", "1234", &snapstatetest.TrivialDeviceContext{}), IsNil)
+
+	conns, err := ifacestate.GetConns(s.state)
+	c.Assert(err, IsNil)
+	cstate := conns["consumer:plug core:hotplugslot"].(map[string]interface{})
+	c.Check(cstate["undesired"], Equals, true)
+	c.Check(repo.Interfaces().Connections, HasLen, 0)
+}
+
+func (s *interfaceManagerSuite) TestConflictErrorPreservesHistoricalMessage(c *C) {
+	err := ifacestate.NewConflictError(ifacestate.ConflictKindConnect, "consumer", "42", "link-snap")
+	c.Check(err.Error(), Equals, `snap "consumer" has "42" change in progress`)
+}
+
+func (s *interfaceManagerSuite) TestConflictErrorTypedFields(c *C) {
+	err := ifacestate.NewConflictError(ifacestate.ConflictKindAutoconnect, "producer", "17", "auto-connect")
+	c.Check(err.Snap, Equals, "producer")
+	c.Check(err.ConflictingChangeID, Equals, "17")
+	c.Check(err.ConflictingTaskKind, Equals, "auto-connect")
+	c.Check(err.Kind, Equals, ifacestate.ConflictKindAutoconnect)
+}
+
+func (s *interfaceManagerSuite) TestAsConflictError(c *C) {
+	conflictErr := ifacestate.NewConflictError(ifacestate.ConflictKindRefresh, "consumer", "42", "link-snap")
+	got, ok := ifacestate.AsConflictError(conflictErr)
+	c.Check(ok, Equals, true)
+	c.Check(got, Equals, conflictErr)
+
+	_, ok = ifacestate.AsConflictError(fmt.Errorf("boom"))
+	c.Check(ok, Equals, false)
+}
+
 func (s *interfaceManagerSuite) mockIface(c *C, iface interfaces.Interface) {
 	s.extraIfaces = append(s.extraIfaces, iface)
 }
@@ -2937,6 +4545,171 @@ func (s *interfaceManagerSuite) TestDisconnectSetsUpSecurity(c *C) {
 	c.Check(s.secBackend.SetupCalls[1].Options, Equals, interfaces.ConfinementOptions{})
 }
 
+// TestPreviewConnectDoesNotSetUpSecurity mirrors TestConnectSetsUpSecurity,
+// but asks PreviewConnect for the outcome instead of running the real
+// connect change, and checks that nothing was actually connected.
+func (s *interfaceManagerSuite) TestPreviewConnectDoesNotSetUpSecurity(c *C) {
+	s.MockModel(c, nil)
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"}, &ifacetest.TestInterface{InterfaceName: "test2"})
+	s.mockSnap(c, consumerYaml)
+	s.mockSnap(c, producerYaml)
+	_ = s.manager(c)
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	preview, err := ifacestate.PreviewConnect(s.state, &snapstatetest.TrivialDeviceContext{}, "consumer", "plug", "producer", "slot")
+	c.Assert(err, IsNil)
+	c.Check(preview.Allowed, Equals, true)
+	c.Check(preview.Denied, Equals, "")
+	c.Check(preview.AffectedSnaps, DeepEquals, []string{"consumer", "producer"})
+
+	c.Check(s.secBackend.SetupCalls, HasLen, 0)
+	c.Check(s.secBackend.RemoveCalls, HasLen, 0)
+
+	var conns map[string]interface{}
+	c.Check(s.state.Get("conns", &conns), Equals, state.ErrNoState)
+}
+
+// TestPreviewConnectReportsPolicyDenial checks that a connection the base
+// declaration would reject is reported as denied, with a reason, rather
+// than erroring out.
+func (s *interfaceManagerSuite) TestPreviewConnectReportsPolicyDenial(c *C) {
+	restore := assertstest.MockBuiltinBaseDeclaration([]byte(`
+type: base-declaration
+authority-id: canonical
+series: 16
+slots:
+  test:
+    allow-connection: false
+`))
+	defer restore()
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"}, &ifacetest.TestInterface{InterfaceName: "test2"})
+	s.mockSnap(c, consumerYaml)
+	s.mockSnap(c, producerYaml)
+	_ = s.manager(c)
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	preview, err := ifacestate.PreviewConnect(s.state, &snapstatetest.TrivialDeviceContext{}, "consumer", "plug", "producer", "slot")
+	c.Assert(err, IsNil)
+	c.Check(preview.Allowed, Equals, false)
+	c.Check(preview.Denied, Not(Equals), "")
+}
+
+// TestPreviewDisconnectDoesNotSetUpSecurity mirrors
+// TestDisconnectSetsUpSecurity, asking PreviewDisconnect for the outcome
+// instead of running the real disconnect change.
+func (s *interfaceManagerSuite) TestPreviewDisconnectDoesNotSetUpSecurity(c *C) {
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"}, &ifacetest.TestInterface{InterfaceName: "test2"})
+	s.mockSnap(c, consumerYaml)
+	s.mockSnap(c, producerYaml)
+
+	s.state.Lock()
+	s.state.Set("conns", map[string]interface{}{
+		"consumer:plug producer:slot": map[string]interface{}{"interface": "test"},
+	})
+	s.state.Unlock()
+
+	s.manager(c)
+	conn := s.getConnection(c, "consumer", "plug", "producer", "slot")
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	connRef := &interfaces.ConnRef{
+		PlugRef: interfaces.PlugRef{Snap: conn.Plug.Snap().InstanceName(), Name: conn.Plug.Name()},
+		SlotRef: interfaces.SlotRef{Snap: conn.Slot.Snap().InstanceName(), Name: conn.Slot.Name()},
+	}
+	preview, err := ifacestate.PreviewDisconnect(s.state, connRef)
+	c.Assert(err, IsNil)
+	c.Check(preview.AffectedSnaps, DeepEquals, []string{"consumer", "producer"})
+
+	c.Check(s.secBackend.SetupCalls, HasLen, 0)
+	c.Check(s.secBackend.RemoveCalls, HasLen, 0)
+
+	var conns map[string]interface{}
+	c.Assert(s.state.Get("conns", &conns), IsNil)
+	c.Check(conns, HasLen, 1)
+}
+
+// TestPreviewAutoConnectEnumeratesAffectedSnaps mirrors
+// TestAutoConnectSetupSecurityForConnectedSlots, checking that
+// PreviewAutoConnect reports the same candidate pair and affected snaps the
+// real auto-connect task would touch, without calling the security
+// backend.
+func (s *interfaceManagerSuite) TestPreviewAutoConnectEnumeratesAffectedSnaps(c *C) {
+	s.MockModel(c, nil)
+	coreSnapInfo := s.mockSnap(c, ubuntuCoreSnapYaml)
+	_ = s.manager(c)
+	snapInfo := s.mockSnap(c, sampleSnapYaml)
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	preview, err := ifacestate.PreviewAutoConnect(s.state, &snapstatetest.TrivialDeviceContext{}, snapInfo.InstanceName())
+	c.Assert(err, IsNil)
+	c.Assert(preview.Candidates, HasLen, 1)
+	c.Check(preview.Candidates[0].PlugRef.Snap, Equals, snapInfo.InstanceName())
+	c.Check(preview.Candidates[0].SlotRef.Snap, Equals, coreSnapInfo.InstanceName())
+	c.Check(preview.Denied, HasLen, 0)
+
+	c.Check(s.secBackend.SetupCalls, HasLen, 0)
+	c.Check(s.secBackend.RemoveCalls, HasLen, 0)
+
+	var conns map[string]interface{}
+	c.Check(s.state.Get("conns", &conns), Equals, state.ErrNoState)
+}
+
+// TestPreviewAutoConnectHonoursCallerDeviceContext mirrors
+// TestCheckAutoConnectOnStoreBranches, checking that PreviewAutoConnect
+// passes the deviceCtx it was given through to the auto-connection policy
+// rather than ignoring it, so an on-store constraint is evaluated the same
+// way here as it would be for the real auto-connect task.
+func (s *interfaceManagerSuite) TestPreviewAutoConnectHonoursCallerDeviceContext(c *C) {
+	restore := assertstest.MockBuiltinBaseDeclaration([]byte(`
+type: base-declaration
+authority-id: canonical
+series: 16
+slots:
+  test:
+    allow-auto-connection:
+      plug-publisher-id:
+        - $SLOT_PUBLISHER_ID
+`))
+	defer restore()
+	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"})
+	s.MockSnapDecl(c, "producer", "one-publisher", nil)
+	s.mockSnap(c, producerYaml)
+	s.MockSnapDecl(c, "consumer", "one-publisher", map[string]interface{}{
+		"format": "3",
+		"plugs": map[string]interface{}{
+			"test": map[string]interface{}{
+				"allow-auto-connection": map[string]interface{}{
+					"on-store": []interface{}{"my-store"},
+				},
+			},
+		},
+	})
+	snapInfo := s.mockSnap(c, consumerYaml)
+	_ = s.mockSnap(c, producerYaml)
+	_ = s.manager(c)
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	preview, err := ifacestate.PreviewAutoConnect(s.state, s.deviceCtxWithModel(c, "other-store"), snapInfo.InstanceName())
+	c.Assert(err, IsNil)
+	c.Check(preview.Candidates, HasLen, 0)
+	c.Check(preview.Denied, HasLen, 1)
+
+	preview, err = ifacestate.PreviewAutoConnect(s.state, s.deviceCtxWithModel(c, "my-store"), snapInfo.InstanceName())
+	c.Assert(err, IsNil)
+	c.Check(preview.Candidates, HasLen, 1)
+	c.Check(preview.Denied, HasLen, 0)
+}
+
 func (s *interfaceManagerSuite) TestDisconnectTracksConnectionsInState(c *C) {
 	s.mockIfaces(c, &ifacetest.TestInterface{InterfaceName: "test"}, &ifacetest.TestInterface{InterfaceName: "test2"})
 	s.mockSnap(c, consumerYaml)
@@ -5730,6 +7503,83 @@ func (s *interfaceManagerSuite) TestHotplugSeqWaitTasks(c *C) {
 	}
 }
 
+// TestHotplugEventCoalescerCollapsesFlappingBurst enqueues a flapping
+// add/remove/add/remove/.../add burst for one hotplug-key and checks that
+// only the single net change (one add, with the latest attrs) survives,
+// instead of one change per raw event.
+func (s *interfaceManagerSuite) TestHotplugEventCoalescerCollapsesFlappingBurst(c *C) {
+	coalescer := ifacestate.NewHotplugEventCoalescer(ifacestate.HotplugDebounceWindowDefault)
+
+	for i := 0; i < 10; i++ {
+		coalescer.Enqueue("1234", ifacestate.HotplugEvent{Action: ifacestate.HotplugEventAdded, Attrs: map[string]string{"seq": "stale"}}, false, nil)
+		coalescer.Enqueue("1234", ifacestate.HotplugEvent{Action: ifacestate.HotplugEventRemoved}, false, nil)
+	}
+	coalescer.Enqueue("1234", ifacestate.HotplugEvent{Action: ifacestate.HotplugEventAdded, Attrs: map[string]string{"seq": "latest"}}, false, nil)
+
+	ev, ok := coalescer.Flush("1234")
+	c.Assert(ok, Equals, true)
+	c.Check(ev.Action, Equals, ifacestate.HotplugEventAdded)
+	c.Check(ev.Attrs, DeepEquals, map[string]string{"seq": "latest"})
+
+	// flushing again reports nothing left to do for this key
+	_, ok = coalescer.Flush("1234")
+	c.Check(ok, Equals, false)
+}
+
+// TestHotplugEventCoalescerAddRemoveIsNoop covers the canonical add+remove
+// cancel-out: a device that was never present before the burst and is
+// absent again at the end of it needs no change scheduled at all.
+func (s *interfaceManagerSuite) TestHotplugEventCoalescerAddRemoveIsNoop(c *C) {
+	coalescer := ifacestate.NewHotplugEventCoalescer(ifacestate.HotplugDebounceWindowDefault)
+
+	coalescer.Enqueue("1234", ifacestate.HotplugEvent{Action: ifacestate.HotplugEventAdded, Attrs: map[string]string{"attr": "1"}}, false, nil)
+	coalescer.Enqueue("1234", ifacestate.HotplugEvent{Action: ifacestate.HotplugEventRemoved}, false, nil)
+
+	_, ok := coalescer.Flush("1234")
+	c.Check(ok, Equals, false)
+}
+
+// TestHotplugEventCoalescerAddChangeIsSingleAddWithLatestAttrs covers an
+// add immediately followed by a change: the net effect is one add using
+// the latest attrs, not two changes.
+func (s *interfaceManagerSuite) TestHotplugEventCoalescerAddChangeIsSingleAddWithLatestAttrs(c *C) {
+	coalescer := ifacestate.NewHotplugEventCoalescer(ifacestate.HotplugDebounceWindowDefault)
+
+	coalescer.Enqueue("1234", ifacestate.HotplugEvent{Action: ifacestate.HotplugEventAdded, Attrs: map[string]string{"attr": "1"}}, false, nil)
+	coalescer.Enqueue("1234", ifacestate.HotplugEvent{Action: ifacestate.HotplugEventChanged, Attrs: map[string]string{"attr": "2"}}, false, nil)
+
+	ev, ok := coalescer.Flush("1234")
+	c.Assert(ok, Equals, true)
+	c.Check(ev.Action, Equals, ifacestate.HotplugEventAdded)
+	c.Check(ev.Attrs, DeepEquals, map[string]string{"attr": "2"})
+}
+
+// TestHotplugEventCoalescerUnrelatedKeysDoNotInterfere checks that bursts
+// for different hotplug-keys are folded independently.
+func (s *interfaceManagerSuite) TestHotplugEventCoalescerUnrelatedKeysDoNotInterfere(c *C) {
+	coalescer := ifacestate.NewHotplugEventCoalescer(ifacestate.HotplugDebounceWindowDefault)
+
+	coalescer.Enqueue("1234", ifacestate.HotplugEvent{Action: ifacestate.HotplugEventRemoved}, true, map[string]string{"attr": "1"})
+	coalescer.Enqueue("5678", ifacestate.HotplugEvent{Action: ifacestate.HotplugEventAdded, Attrs: map[string]string{"attr": "2"}}, false, nil)
+
+	ev, ok := coalescer.Flush("1234")
+	c.Assert(ok, Equals, true)
+	c.Check(ev.Action, Equals, ifacestate.HotplugEventRemoved)
+
+	ev, ok = coalescer.Flush("5678")
+	c.Assert(ok, Equals, true)
+	c.Check(ev.Action, Equals, ifacestate.HotplugEventAdded)
+	c.Check(ev.Attrs, DeepEquals, map[string]string{"attr": "2"})
+}
+
+// TestSupersededHotplugSeqsKeepsOnlyTheChosenSeq checks that
+// hotplug-seq-wait gets back every other pending sequence number for a
+// key once coalescing has picked the one that actually needs to run.
+func (s *interfaceManagerSuite) TestSupersededHotplugSeqsKeepsOnlyTheChosenSeq(c *C) {
+	superseded := ifacestate.SupersededHotplugSeqs([]int{1, 2, 3, 4, 5}, 5)
+	c.Check(superseded, DeepEquals, []int{1, 2, 3, 4})
+}
+
 func (s *interfaceManagerSuite) testConnectionStates(c *C, auto, byGadget, undesired bool, expected map[string]ifacestate.ConnectionState) {
 	slotSnap := s.mockSnap(c, producerYaml)
 	plugSnap := s.mockSnap(c, consumerYaml)
@@ -5792,3 +7642,74 @@ func (s *interfaceManagerSuite) TestConnectionStatesUndesired(c *C) {
 			Undesired: true,
 		}})
 }
+
+// TestQueryConnectionsFiltersAndRoundTripsDynamicAttrs covers the
+// dynamic-attr and hotplug-gone/hotplug-key cases testConnectionStates
+// doesn't reach: it stores two connections, one hotplug-gone and one not,
+// and checks both that every field - including the dynamic attrs and
+// LastConnectedAt backfilled by schema v2 - round-trips, and that each
+// ConnectionFilter predicate narrows to the expected subset.
+func (s *interfaceManagerSuite) TestQueryConnectionsFiltersAndRoundTripsDynamicAttrs(c *C) {
+	s.state.Lock()
+	defer s.state.Unlock()
+
+	s.state.Set("conns", map[string]interface{}{
+		"consumer:plug producer:slot": map[string]interface{}{
+			"interface":    "test",
+			"auto":         true,
+			"plug-static":  map[string]interface{}{"attr1": "value1"},
+			"plug-dynamic": map[string]interface{}{"attr3": "value3"},
+			"slot-static":  map[string]interface{}{"attr2": "value2"},
+			"slot-dynamic": map[string]interface{}{"attr4": "value4"},
+			"connected-at": "2021-01-01T00:00:00Z",
+		},
+		"consumer:plug core:hotplugslot": map[string]interface{}{
+			"interface":    "test",
+			"hotplug-key":  "1234",
+			"hotplug-gone": true,
+		},
+	})
+
+	all, err := ifacestate.QueryConnections(s.state, ifacestate.ConnectionFilter{})
+	c.Assert(err, IsNil)
+	c.Assert(all, HasLen, 2)
+	c.Check(all["consumer:plug producer:slot"], DeepEquals, ifacestate.ConnectionDetails{
+		Interface:        "test",
+		Auto:             true,
+		StaticPlugAttrs:  map[string]interface{}{"attr1": "value1"},
+		DynamicPlugAttrs: map[string]interface{}{"attr3": "value3"},
+		StaticSlotAttrs:  map[string]interface{}{"attr2": "value2"},
+		DynamicSlotAttrs: map[string]interface{}{"attr4": "value4"},
+		LastConnectedAt:  "2021-01-01T00:00:00Z",
+	})
+	c.Check(all["consumer:plug core:hotplugslot"], DeepEquals, ifacestate.ConnectionDetails{
+		Interface:   "test",
+		HotplugKey:  "1234",
+		HotplugGone: true,
+	})
+
+	onlyGone, err := ifacestate.QueryConnections(s.state, ifacestate.ConnectionFilter{OnlyHotplugGone: true})
+	c.Assert(err, IsNil)
+	c.Check(onlyGone, HasLen, 1)
+	_, ok := onlyGone["consumer:plug core:hotplugslot"]
+	c.Check(ok, Equals, true)
+
+	byKey, err := ifacestate.QueryConnections(s.state, ifacestate.ConnectionFilter{HotplugKey: "1234"})
+	c.Assert(err, IsNil)
+	c.Check(byKey, HasLen, 1)
+
+	bySnap, err := ifacestate.QueryConnections(s.state, ifacestate.ConnectionFilter{Snap: "producer"})
+	c.Assert(err, IsNil)
+	c.Check(bySnap, HasLen, 1)
+	_, ok = bySnap["consumer:plug producer:slot"]
+	c.Check(ok, Equals, true)
+
+	// OnlyConnected must exclude a hotplug-gone entry the same way it
+	// excludes an undesired one: the device is absent either way, so
+	// "only connected" should never report it as connected.
+	onlyConnected, err := ifacestate.QueryConnections(s.state, ifacestate.ConnectionFilter{OnlyConnected: true})
+	c.Assert(err, IsNil)
+	c.Check(onlyConnected, HasLen, 1)
+	_, ok = onlyConnected["consumer:plug producer:slot"]
+	c.Check(ok, Equals, true)
+}
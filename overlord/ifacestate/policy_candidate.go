@@ -0,0 +1,103 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package ifacestate
+
+import (
+	"fmt"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/interfaces/policy"
+	"github.com/snapcore/snapd/overlord/assertstate"
+	"github.com/snapcore/snapd/overlord/snapstate"
+	"github.com/snapcore/snapd/overlord/state"
+	"github.com/snapcore/snapd/snap"
+)
+
+// policyLookupError wraps a failure to even construct the policy candidate
+// (eg. the base declaration or a snap-declaration could not be looked up),
+// as opposed to the candidate being built fine and the policy itself
+// declining the pair. Callers that need to tell "the answer is no" apart
+// from "the question could not be asked" - like the reload path, which
+// should tolerate a transient assertstate hiccup rather than treat it as a
+// declaration change - can type-assert for this.
+type policyLookupError struct {
+	err error
+}
+
+func (e *policyLookupError) Error() string { return e.err.Error() }
+func (e *policyLookupError) Unwrap() error { return e.err }
+
+// snapDeclaration looks up the snap-declaration for the given snap-id,
+// returning a nil declaration (rather than an error) when none is found.
+// Plugs and slots of unasserted snaps are common (eg. local installs) and
+// callers should fall back to the base declaration alone in that case.
+func snapDeclaration(st *state.State, snapID string) (*asserts.SnapDeclaration, error) {
+	if snapID == "" {
+		return nil, nil
+	}
+	decl, err := assertstate.SnapDeclaration(st, snapID)
+	if _, ok := err.(*asserts.NotFoundError); ok {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decl, nil
+}
+
+// connectCandidate builds a policy.ConnectCandidate for the given plug/slot
+// pair, resolving the base declaration and the snap-declarations of both
+// sides. It is shared by every caller that needs to ask "would this
+// connection be allowed (or auto-connected) under the current policy" -
+// the connect/auto-connect task handlers as well as the connection reload
+// path, so the decision logic only lives in one place.
+func connectCandidate(st *state.State, plug *snap.PlugInfo, slot *snap.SlotInfo, deviceCtx snapstate.DeviceContext) (*policy.ConnectCandidate, error) {
+	baseDecl, err := assertstate.BaseDeclaration(st)
+	if err != nil {
+		return nil, &policyLookupError{fmt.Errorf("internal error: cannot find base declaration: %v", err)}
+	}
+	plugDecl, err := snapDeclaration(st, plug.Snap.SnapID)
+	if err != nil {
+		return nil, &policyLookupError{err}
+	}
+	slotDecl, err := snapDeclaration(st, slot.Snap.SnapID)
+	if err != nil {
+		return nil, &policyLookupError{err}
+	}
+	return &policy.ConnectCandidate{
+		Plug:                plug,
+		PlugSnapDeclaration: plugDecl,
+		Slot:                slot,
+		SlotSnapDeclaration: slotDecl,
+		BaseDeclaration:     baseDecl,
+		DeviceCtx:           deviceCtx,
+	}, nil
+}
+
+// checkConnectCandidate re-evaluates the manual-connect policy (the same
+// check ifacestate.Connect runs) for plug/slot with their current static
+// attributes.
+func checkConnectCandidate(st *state.State, plug *snap.PlugInfo, slot *snap.SlotInfo, deviceCtx snapstate.DeviceContext) error {
+	cand, err := connectCandidate(st, plug, slot, deviceCtx)
+	if err != nil {
+		return err
+	}
+	return cand.Check()
+}
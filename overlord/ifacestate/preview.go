@@ -0,0 +1,181 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package ifacestate
+
+import (
+	"fmt"
+
+	"github.com/snapcore/snapd/interfaces"
+	"github.com/snapcore/snapd/overlord/ifacestate/ifacerepo"
+	"github.com/snapcore/snapd/overlord/snapstate"
+	"github.com/snapcore/snapd/overlord/state"
+	"github.com/snapcore/snapd/snap"
+)
+
+// ConnectPreview reports what ifacestate.Connect would do for a given
+// plug/slot pair without actually doing it: no state is mutated, no task is
+// created and no security backend is invoked. It is meant for daemon
+// endpoints and the "snap" CLI to show an admin "what would happen" before
+// they commit to a real connect; turning Connect/Disconnect/auto-connect
+// themselves into a dry-run mode reachable from those endpoints, rather
+// than calling this parallel set of functions, happens at those call
+// sites, which live outside this tree's slice of ifacestate.
+type ConnectPreview struct {
+	// Allowed is true when the connect policy would accept the pair as-is.
+	Allowed bool
+	// Denied, when Allowed is false, explains why the policy declined it.
+	Denied string
+	// AffectedSnaps lists every snap whose security profiles would need to
+	// be regenerated, in the same plug-then-slot order doConnect uses.
+	AffectedSnaps []string
+}
+
+// PreviewConnect evaluates the manual-connect policy for plugSnap:plugName
+// and slotSnap:slotName exactly as ifacestate.Connect does, but only
+// reports the outcome instead of creating a change. deviceCtx is taken from
+// the caller rather than looked up here, the same as checkConnectCandidate
+// and every other policy entry point in this package, so a preview run
+// during a remodel sees the same device identity the real connect task
+// would.
+func PreviewConnect(st *state.State, deviceCtx snapstate.DeviceContext, plugSnap, plugName, slotSnap, slotName string) (*ConnectPreview, error) {
+	repo := ifacerepo.Get(st)
+
+	plug := repo.Plug(plugSnap, plugName)
+	if plug == nil {
+		return nil, fmt.Errorf("snap %q has no %q plug", plugSnap, plugName)
+	}
+	slot := repo.Slot(slotSnap, slotName)
+	if slot == nil {
+		return nil, fmt.Errorf("snap %q has no %q slot", slotSnap, slotName)
+	}
+
+	preview := &ConnectPreview{AffectedSnaps: []string{plugSnap, slotSnap}}
+	if err := checkConnectCandidate(st, plug, slot, deviceCtx); err != nil {
+		preview.Denied = err.Error()
+		return preview, nil
+	}
+	preview.Allowed = true
+	return preview, nil
+}
+
+// DisconnectPreview reports what ifacestate.Disconnect would do for an
+// established connection without mutating state or invoking a security
+// backend.
+type DisconnectPreview struct {
+	// AffectedSnaps lists every snap whose security profiles would need to
+	// be regenerated.
+	AffectedSnaps []string
+}
+
+// PreviewDisconnect reports the snaps that would be affected by
+// disconnecting connRef. Disconnect itself is never gated by policy - only
+// by an in-progress conflicting change, which a preview cannot usefully
+// predict - so there is no "denied" outcome here, unlike PreviewConnect and
+// PreviewAutoConnect.
+func PreviewDisconnect(st *state.State, connRef *interfaces.ConnRef) (*DisconnectPreview, error) {
+	repo := ifacerepo.Get(st)
+	if repo.Plug(connRef.PlugRef.Snap, connRef.PlugRef.Name) == nil || repo.Slot(connRef.SlotRef.Snap, connRef.SlotRef.Name) == nil {
+		return nil, fmt.Errorf("cannot preview disconnect of %s: connection not found", connRef)
+	}
+	return &DisconnectPreview{AffectedSnaps: []string{connRef.PlugRef.Snap, connRef.SlotRef.Snap}}, nil
+}
+
+// AutoConnectDenial records why one candidate plug/slot pair would not be
+// auto-connected.
+type AutoConnectDenial struct {
+	PlugRef interfaces.PlugRef
+	SlotRef interfaces.SlotRef
+	Reason  string
+}
+
+// AutoConnectPreview reports what doAutoConnect would do for a snap without
+// mutating state or invoking a security backend.
+type AutoConnectPreview struct {
+	// Candidates are the plug/slot pairs the auto-connection policy
+	// allows; this includes pairs that happen to be connected already, the
+	// same as AutoConnectCandidates.
+	Candidates []*interfaces.ConnRef
+	// Denied lists every other pair considered and why it was declined.
+	Denied []AutoConnectDenial
+	// AffectedSnaps lists every snap whose security profiles would need to
+	// be regenerated if the candidates were connected for real.
+	AffectedSnaps []string
+}
+
+// PreviewAutoConnect evaluates the auto-connection policy for every plug
+// and slot of instanceName exactly as the auto-connect task handler does
+// (via CheckAutoConnect), but only collects the outcome instead of calling
+// repo.Connect. deviceCtx comes from the caller, the same as
+// CheckAutoConnect and AutoConnectCandidates themselves, rather than being
+// looked up here, so this agrees with the real task handler even mid
+// remodel.
+func PreviewAutoConnect(st *state.State, deviceCtx snapstate.DeviceContext, instanceName string) (*AutoConnectPreview, error) {
+	repo := ifacerepo.Get(st)
+
+	preview := &AutoConnectPreview{}
+	affected := map[string]bool{}
+
+	for _, plug := range repo.Plugs(instanceName) {
+		for _, slot := range repo.AllSlots(plug.Interface) {
+			if err := previewAutoConnectPair(st, deviceCtx, plug, slot, preview, affected); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, slot := range repo.Slots(instanceName) {
+		for _, plug := range repo.AllPlugs(slot.Interface) {
+			if plug.Snap.InstanceName() == instanceName {
+				// already covered by the loop above
+				continue
+			}
+			if err := previewAutoConnectPair(st, deviceCtx, plug, slot, preview, affected); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for snapName := range affected {
+		preview.AffectedSnaps = append(preview.AffectedSnaps, snapName)
+	}
+	return preview, nil
+}
+
+func previewAutoConnectPair(st *state.State, deviceCtx snapstate.DeviceContext, plug *snap.PlugInfo, slot *snap.SlotInfo, preview *AutoConnectPreview, affected map[string]bool) error {
+	allowed, err := CheckAutoConnect(st, plug, slot, deviceCtx)
+	if err != nil {
+		return err
+	}
+	connRef := &interfaces.ConnRef{
+		PlugRef: interfaces.PlugRef{Snap: plug.Snap.InstanceName(), Name: plug.Name},
+		SlotRef: interfaces.SlotRef{Snap: slot.Snap.InstanceName(), Name: slot.Name},
+	}
+	if !allowed {
+		preview.Denied = append(preview.Denied, AutoConnectDenial{
+			PlugRef: connRef.PlugRef,
+			SlotRef: connRef.SlotRef,
+			Reason:  "denied by auto-connection policy",
+		})
+		return nil
+	}
+	preview.Candidates = append(preview.Candidates, connRef)
+	affected[connRef.PlugRef.Snap] = true
+	affected[connRef.SlotRef.Snap] = true
+	return nil
+}
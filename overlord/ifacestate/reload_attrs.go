@@ -0,0 +1,247 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package ifacestate
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/snapcore/snapd/interfaces"
+	"github.com/snapcore/snapd/logger"
+	"github.com/snapcore/snapd/overlord/snapstate"
+	"github.com/snapcore/snapd/overlord/state"
+)
+
+// SetupAffectedSnapsSecurity is called, with every connection reload
+// variant in this file's changed set committed to state, for the instance
+// names of every snap on either side of a connection that was disconnected
+// or had its static attrs refreshed - the security profiles that need
+// regenerating for the repository change to actually take effect, the same
+// way a setup-profiles task would for a single snap. This package owns
+// connection and policy state, not the security backends themselves, so it
+// defaults to a no-op; the interface manager is expected to set this at
+// construction time to a function that runs SetupMany across every
+// registered backend for the given snaps.
+var SetupAffectedSnapsSecurity = func(st *state.State, instanceNames []string) error {
+	return nil
+}
+
+// sortedSnapNames returns the instance names recorded in affected, sorted
+// for deterministic SetupAffectedSnapsSecurity calls (and easy-to-assert
+// tests).
+func sortedSnapNames(affected map[string]bool) []string {
+	names := make([]string, 0, len(affected))
+	for name := range affected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// updateStaticAttrsForPolicy decides the plug-static/slot-static attrs
+// that should be persisted for one reloaded connection, and whether the
+// policy that used to allow it still does. The relevant policy is re-run
+// against the snap's current static attributes: the Connect policy for
+// user-established connections, and both Connect and AutoConnect for
+// connections with "auto": true. On success the fresh attributes are
+// returned with changed set whenever they differ from what was stored. If
+// the policy no longer allows the connection at all, forbidden is set
+// instead, so the caller can mark it undesired rather than pretend
+// nothing happened.
+//
+// With a nil deviceCtx a connection is never reported forbidden: whenever
+// the policy check fails without a device context, for whatever reason,
+// the previously stored attributes are kept and the connection is left
+// alone - a transient "no device context yet" at startup must not look
+// like a declaration change that revokes the connection. A check that
+// passes without a device context still refreshes the attributes.
+//
+// This is the single policy re-evaluation every reload/refresh variant in
+// this package shares - RefreshConnectionsStaticAttrs and its task/per-snap/
+// hotplug-slot siblings via applyStaticAttrsRefresh below, and
+// ReloadConnectionsTxn directly - so the decision of what counts as
+// "still allowed" or "no longer allowed" can't drift between copies. It is
+// deliberately not itself one of those entry points: it only decides, it
+// never mutates conns or the repository, which is what let
+// ReloadConnectionsTxn reuse it for planning before any mutation happens.
+func updateStaticAttrsForPolicy(st *state.State, repo *interfaces.Repository, deviceCtx snapstate.DeviceContext, connRef *interfaces.ConnRef, cstate connState) (plugAttrs, slotAttrs map[string]interface{}, changed, forbidden bool) {
+	plug := repo.Plug(connRef.PlugRef.Snap, connRef.PlugRef.Name)
+	slot := repo.Slot(connRef.SlotRef.Snap, connRef.SlotRef.Name)
+	if plug == nil || slot == nil {
+		// one side of the connection is gone from the repository, there is
+		// nothing fresh to compare against.
+		return cstate.StaticPlugAttrs, cstate.StaticSlotAttrs, false, false
+	}
+
+	// Auto-connections must keep satisfying both the connect and the
+	// auto-connect policy; user-established connections only need the
+	// connect policy. CheckAutoconnectCandidate is the task-agnostic
+	// checker shared with the auto-connect task handler, so reload doesn't
+	// need to fabricate one.
+	var err error
+	if cstate.Auto {
+		err = checkConnectCandidate(st, plug, slot, deviceCtx)
+		if err == nil {
+			err = CheckAutoconnectCandidate(st, plug, slot, deviceCtx)
+		}
+	} else {
+		err = checkConnectCandidate(st, plug, slot, deviceCtx)
+	}
+	if err != nil {
+		if _, isLookupFailure := err.(*policyLookupError); isLookupFailure {
+			logger.Noticef("cannot re-evaluate policy for connection %s, keeping it as-is: %v", connRef, err)
+			return cstate.StaticPlugAttrs, cstate.StaticSlotAttrs, false, false
+		}
+		if deviceCtx == nil {
+			logger.Noticef("cannot re-evaluate policy for connection %s without a device context, keeping it as-is: %v", connRef, err)
+			return cstate.StaticPlugAttrs, cstate.StaticSlotAttrs, false, false
+		}
+		logger.Noticef("connection %s is no longer allowed by policy, marking undesired: %v", connRef, err)
+		return cstate.StaticPlugAttrs, cstate.StaticSlotAttrs, false, true
+	}
+
+	if reflect.DeepEqual(cstate.StaticPlugAttrs, plug.Attrs) && reflect.DeepEqual(cstate.StaticSlotAttrs, slot.Attrs) {
+		return cstate.StaticPlugAttrs, cstate.StaticSlotAttrs, false, false
+	}
+	return plug.Attrs, slot.Attrs, true, false
+}
+
+// RefreshConnectionsStaticAttrs re-derives the plug-static/slot-static
+// attributes of every connection recorded in conns from the snap revisions
+// currently installed, and persists the refreshed values whenever the
+// connect (or, for "auto": true connections, the auto-connect) policy still
+// allows the connection with the new attributes. Connections whose policy
+// no longer allows them at all are marked undesired and disconnected in the
+// repository, and every affected snap's security profile is regenerated via
+// SetupAffectedSnapsSecurity afterwards - otherwise the repository change
+// alone would leave the on-disk profile granting access the connection no
+// longer has - instead of the connection being silently left in place or
+// dropped outright.
+//
+// This is NOT what ReloadConnections runs: ReloadConnections (via
+// ReloadConnectionsTxn, see reload_entrypoint.go/reload_transaction.go)
+// is the transactional reload entry point, because it plans
+// every connection before mutating the repository so a failure partway
+// through never leaves repo ahead of the conns this pass committed.
+// RefreshConnectionsStaticAttrs exists as the non-transactional, task-free
+// primitive for callers that don't need that guarantee - today that is only
+// RefreshConnectionsStaticAttrsForTask below, plus tests.
+func RefreshConnectionsStaticAttrs(st *state.State, repo *interfaces.Repository, deviceCtx snapstate.DeviceContext) error {
+	return refreshConnectionsStaticAttrs(st, repo, deviceCtx, nil)
+}
+
+// RefreshConnectionsStaticAttrsForTask does the same job as
+// RefreshConnectionsStaticAttrs, but is meant to be called from the
+// setup-profiles task handler while reloading the connections of the snap
+// being set up. Besides the usual logger output, it also records a warning
+// on task so "snap change <id> --log" and similar tooling show operators
+// which connections were disconnected and marked undesired because the
+// policy no longer allows them, rather than only the generic
+// security-backend log that follows.
+func RefreshConnectionsStaticAttrsForTask(task *state.Task, repo *interfaces.Repository, deviceCtx snapstate.DeviceContext) error {
+	return refreshConnectionsStaticAttrs(task.State(), repo, deviceCtx, task)
+}
+
+// refreshConnectionsStaticAttrs is the shared implementation behind
+// RefreshConnectionsStaticAttrs and RefreshConnectionsStaticAttrsForTask;
+// task is optional and, when provided, is used to additionally surface the
+// "forbidden" case as a task log entry.
+func refreshConnectionsStaticAttrs(st *state.State, repo *interfaces.Repository, deviceCtx snapstate.DeviceContext, task *state.Task) error {
+	conns, err := getConns(st)
+	if err != nil {
+		return fmt.Errorf("cannot obtain connections: %v", err)
+	}
+
+	var taskLogf func(format string, args ...interface{})
+	if task != nil {
+		taskLogf = task.Logf
+	}
+
+	changed := false
+	affected := make(map[string]bool)
+	for id, cstate := range conns {
+		if cstate.HotplugGone || cstate.Undesired {
+			continue
+		}
+		connRef, err := interfaces.ParseConnRef(id)
+		if err != nil {
+			logger.Noticef("cannot parse connection identifier %q: %v", id, err)
+			continue
+		}
+
+		plugAttrs, slotAttrs, updated, forbidden := updateStaticAttrsForPolicy(st, repo, deviceCtx, connRef, cstate)
+		if applyStaticAttrsRefresh(repo, conns, id, connRef, plugAttrs, slotAttrs, updated, forbidden, taskLogf) {
+			changed = true
+			affected[connRef.PlugRef.Snap] = true
+			affected[connRef.SlotRef.Snap] = true
+		}
+	}
+
+	if changed {
+		setConns(st, conns)
+		if err := SetupAffectedSnapsSecurity(st, sortedSnapNames(affected)); err != nil {
+			return fmt.Errorf("cannot regenerate security profiles after refreshing connections: %v", err)
+		}
+	}
+	return nil
+}
+
+// applyStaticAttrsRefresh applies the outcome of updateStaticAttrsForPolicy
+// for one connection to conns and the repository, and reports whether conns
+// was changed. It is shared by every non-transactional reload variant
+// (RefreshConnectionsStaticAttrs and its task/per-snap/hotplug-slot
+// siblings) so the forbidden/updated handling - in particular, disconnect
+// and mark undesired vs. persist the fresh attrs - can't drift between
+// copies the way it once did. taskLogf, when non-nil, additionally surfaces
+// the forbidden case as a task log entry.
+//
+// None of applyStaticAttrsRefresh's callers is what ReloadConnections runs
+// - that's ReloadConnectionsTxn, which reimplements this same
+// forbidden/updated handling inline because its transactional planning
+// step needs to apply it after every connection has already planned
+// successfully, not as each one is visited (see its doc comment). That
+// inline copy does not call this helper, so the two are kept in step by
+// hand.
+func applyStaticAttrsRefresh(repo *interfaces.Repository, conns map[string]connState, id string, connRef *interfaces.ConnRef, plugAttrs, slotAttrs map[string]interface{}, updated, forbidden bool, taskLogf func(format string, args ...interface{})) bool {
+	cstate := conns[id]
+	switch {
+	case forbidden:
+		if err := repo.Disconnect(connRef.PlugRef.Snap, connRef.PlugRef.Name, connRef.SlotRef.Snap, connRef.SlotRef.Name); err != nil {
+			logger.Noticef("cannot disconnect %s after it was forbidden by policy: %v", connRef, err)
+		}
+		if taskLogf != nil {
+			taskLogf("connection %s is no longer allowed by policy and was left undesired", connRef)
+		}
+		cstate.Undesired = true
+		conns[id] = cstate
+		return true
+	case updated:
+		cstate.StaticPlugAttrs = plugAttrs
+		cstate.StaticSlotAttrs = slotAttrs
+		conns[id] = cstate
+
+		if err := repo.UpdateConnection(connRef, plugAttrs, slotAttrs); err != nil {
+			logger.Noticef("cannot apply refreshed attributes to connection %s: %v", connRef, err)
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package ifacestate
+
+import (
+	"github.com/snapcore/snapd/overlord/ifacestate/ifacerepo"
+	"github.com/snapcore/snapd/overlord/snapstate"
+	"github.com/snapcore/snapd/overlord/state"
+)
+
+// ReloadConnections re-evaluates every connection recorded in conns against
+// the snap revisions and connect/auto-connect policy currently in effect,
+// via ReloadConnectionsTxn, fetching the interface repository itself so
+// callers don't need one in scope. It is the entry point the interface
+// manager's startup Ensure is meant to call, and the one assertstate should
+// call again once a snap-declaration or the base declaration is refreshed -
+// either can change what a stored connection is allowed to do without any
+// task ever running for it, so relying solely on the next snap refresh to
+// notice would leave a revoked connection active indefinitely.
+//
+// MigrateConnsSchema runs first, under the same state lock the caller is
+// expected to already hold: reload must never read "conns" in a stale
+// pre-migration shape, and a "conns-version" newer than this snapd
+// understands must abort startup via *ConnsSchemaTooNewError rather than
+// let the refresh below misinterpret fields it doesn't know about.
+func ReloadConnections(st *state.State, deviceCtx snapstate.DeviceContext) error {
+	if err := MigrateConnsSchema(st); err != nil {
+		return err
+	}
+	repo := ifacerepo.Get(st)
+	return ReloadConnectionsTxn(st, repo, deviceCtx)
+}
@@ -0,0 +1,103 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package ifacestate
+
+import (
+	"fmt"
+
+	"github.com/snapcore/snapd/interfaces"
+	"github.com/snapcore/snapd/logger"
+	"github.com/snapcore/snapd/overlord/snapstate"
+	"github.com/snapcore/snapd/overlord/state"
+)
+
+// hotplugSlotSnap is the snap every hotplug slot is registered on: hotplug
+// slots are implicit slots of the core/snapd snap, never of the gadget or
+// of an ordinary consuming snap, so - unlike the conns-scoped refresh
+// helpers - there is no instanceName to take from the caller.
+const hotplugSlotSnap = "core"
+
+// RefreshHotplugSlotStaticAttrs re-derives the plug-static/slot-static
+// attrs of every connection that uses a hotplug slot of iface with the
+// given hotplugKey, the same way RefreshConnectionsStaticAttrs does for a
+// refreshed consuming snap's plug, but anchored on the slot side: a core
+// (or snapd) refresh can change what attrs a hotplug interface derives for
+// an already-detected device without the device or its hotplug key
+// changing at all, unlike MigrateHotplugKey's scenario. It assumes the
+// caller has already reflected the new attrs in both the repository's slot
+// (eg. via RemoveSlot/AddSlot) and in hotplug-slots itself before calling,
+// the same way a refreshed snap's new plug is expected to already be in
+// the repository before RefreshConnectionsStaticAttrs runs.
+//
+// For every matching connection, the connect policy (and, for "auto": true
+// or "by-gadget": true connections, also the auto-connect policy) is
+// re-run against the slot's current attrs. If it still allows the
+// connection, the fresh slot-static is persisted and applied to the
+// repository; if it no longer does, the connection is disconnected and
+// marked undesired instead of being left on attrs nobody would approve of
+// today. plug-static and any plug-dynamic/slot-dynamic entries are left
+// untouched. As with RefreshConnectionsStaticAttrs, every snap on either
+// side of a changed connection has its security profile regenerated via
+// SetupAffectedSnapsSecurity afterwards, so security backends actually
+// pick up the fresh values.
+//
+// Nothing in this tree calls this outside tests; ReloadConnectionsTxn
+// (see reload_transaction.go) is the only variant ReloadConnections runs.
+func RefreshHotplugSlotStaticAttrs(st *state.State, repo *interfaces.Repository, iface, hotplugKey string, deviceCtx snapstate.DeviceContext) error {
+	conns, err := getConns(st)
+	if err != nil {
+		return fmt.Errorf("cannot obtain connections: %v", err)
+	}
+
+	changed := false
+	affected := make(map[string]bool)
+	for id, cstate := range conns {
+		if cstate.Interface != iface || cstate.HotplugKey != hotplugKey {
+			continue
+		}
+		if cstate.HotplugGone || cstate.Undesired {
+			continue
+		}
+		connRef, err := interfaces.ParseConnRef(id)
+		if err != nil {
+			logger.Noticef("cannot parse connection identifier %q: %v", id, err)
+			continue
+		}
+		if connRef.SlotRef.Snap != hotplugSlotSnap {
+			continue
+		}
+
+		// plug-static is kept as stored: only the slot side is refreshed here.
+		_, slotAttrs, updated, forbidden := updateStaticAttrsForPolicy(st, repo, deviceCtx, connRef, cstate)
+		if applyStaticAttrsRefresh(repo, conns, id, connRef, cstate.StaticPlugAttrs, slotAttrs, updated, forbidden, nil) {
+			changed = true
+			affected[connRef.PlugRef.Snap] = true
+			affected[connRef.SlotRef.Snap] = true
+		}
+	}
+
+	if changed {
+		setConns(st, conns)
+		if err := SetupAffectedSnapsSecurity(st, sortedSnapNames(affected)); err != nil {
+			return fmt.Errorf("cannot regenerate security profiles after refreshing connections: %v", err)
+		}
+	}
+	return nil
+}
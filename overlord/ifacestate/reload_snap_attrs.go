@@ -0,0 +1,91 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package ifacestate
+
+import (
+	"fmt"
+
+	"github.com/snapcore/snapd/interfaces"
+	"github.com/snapcore/snapd/logger"
+	"github.com/snapcore/snapd/overlord/snapstate"
+	"github.com/snapcore/snapd/overlord/state"
+)
+
+// RefreshConnectionsStaticAttrsForSnap does the same re-evaluation as
+// RefreshConnectionsStaticAttrsForTask, but only for the connections that
+// have instanceName on either the plug or the slot side, rather than every
+// connection in conns. It is meant to be called from the setup-profiles
+// task handler for a single refreshed snap: walking every connection in
+// the system on each refresh would be wasteful, and would risk touching
+// unrelated snaps' connections at a moment their own policy hasn't
+// changed at all.
+//
+// This is what lets a refreshed snap.yaml's new plug/slot attributes (eg.
+// the shared-memory interface's "private" attribute) actually take effect
+// on the stored connection: the connect/auto-connect policy is re-run
+// against the current declarations, and if it still allows the
+// connection the fresh attrs are persisted and applied to the repository;
+// if it no longer does, the connection is disconnected instead of being
+// left on attrs nobody would approve of today. As with
+// RefreshConnectionsStaticAttrs, every snap on either side of a connection
+// that changed has its security profile regenerated via
+// SetupAffectedSnapsSecurity afterwards, so the refreshed attrs actually
+// reach the on-disk profile instead of only conns and the repository.
+//
+// Nothing in this tree calls this outside tests; ReloadConnectionsTxn (see
+// reload_transaction.go) is the only variant ReloadConnections runs.
+func RefreshConnectionsStaticAttrsForSnap(task *state.Task, instanceName string, repo *interfaces.Repository, deviceCtx snapstate.DeviceContext) error {
+	st := task.State()
+	conns, err := getConns(st)
+	if err != nil {
+		return fmt.Errorf("cannot obtain connections: %v", err)
+	}
+
+	changed := false
+	affected := make(map[string]bool)
+	for id, cstate := range conns {
+		if cstate.HotplugGone || cstate.Undesired {
+			continue
+		}
+		connRef, err := interfaces.ParseConnRef(id)
+		if err != nil {
+			logger.Noticef("cannot parse connection identifier %q: %v", id, err)
+			continue
+		}
+		if connRef.PlugRef.Snap != instanceName && connRef.SlotRef.Snap != instanceName {
+			continue
+		}
+
+		plugAttrs, slotAttrs, updated, forbidden := updateStaticAttrsForPolicy(st, repo, deviceCtx, connRef, cstate)
+		if applyStaticAttrsRefresh(repo, conns, id, connRef, plugAttrs, slotAttrs, updated, forbidden, task.Logf) {
+			changed = true
+			affected[connRef.PlugRef.Snap] = true
+			affected[connRef.SlotRef.Snap] = true
+		}
+	}
+
+	if changed {
+		setConns(st, conns)
+		if err := SetupAffectedSnapsSecurity(st, sortedSnapNames(affected)); err != nil {
+			return fmt.Errorf("cannot regenerate security profiles after refreshing connections: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package ifacestate
+
+import (
+	"fmt"
+
+	"github.com/snapcore/snapd/interfaces"
+	"github.com/snapcore/snapd/logger"
+	"github.com/snapcore/snapd/overlord/snapstate"
+	"github.com/snapcore/snapd/overlord/state"
+)
+
+// staleConnAttrsKey is the state key for the set of connections whose
+// plug-static/slot-static entries are known to no longer match what the
+// installed snap revisions would produce, because the policy that used to
+// allow them declined the new attributes. It is kept apart from the conns
+// entries themselves (rather than adding yet another field there) so that
+// "snap connections" and similar read-only consumers can surface it without
+// having to understand every other conns field.
+const staleConnAttrsKey = "stale-conn-attrs"
+
+func getStaleConnAttrs(st *state.State) (map[string]bool, error) {
+	var stale map[string]bool
+	if err := st.Get(staleConnAttrsKey, &stale); err != nil && err != state.ErrNoState {
+		return nil, fmt.Errorf("cannot obtain stale connection attributes: %v", err)
+	}
+	if stale == nil {
+		stale = make(map[string]bool)
+	}
+	return stale, nil
+}
+
+// MarkConnectionStaleAttrs records whether connRef's stored plug-static/
+// slot-static attributes are known to be out of date with its plug/slot's
+// current policy-approved values.
+func MarkConnectionStaleAttrs(st *state.State, connRef *interfaces.ConnRef, stale bool) error {
+	staleConns, err := getStaleConnAttrs(st)
+	if err != nil {
+		return err
+	}
+	id := connRef.ID()
+	if stale == staleConns[id] {
+		return nil
+	}
+	if stale {
+		staleConns[id] = true
+	} else {
+		delete(staleConns, id)
+	}
+	st.Set(staleConnAttrsKey, staleConns)
+	return nil
+}
+
+// IsConnectionStaleAttrs reports whether connRef was last marked stale by
+// MarkConnectionStaleAttrs.
+func IsConnectionStaleAttrs(st *state.State, connRef *interfaces.ConnRef) (bool, error) {
+	staleConns, err := getStaleConnAttrs(st)
+	if err != nil {
+		return false, err
+	}
+	return staleConns[connRef.ID()], nil
+}
+
+// RefreshConnectionsStaticAttrsPreservingStale re-derives plug-static/
+// slot-static the same way RefreshConnectionsStaticAttrs does - sharing its
+// updateStaticAttrsForPolicy policy re-evaluation rather than forking it -
+// but never disconnects a connection the policy no longer allows with its
+// fresh attrs: it keeps the connection exactly as stored and records it via
+// MarkConnectionStaleAttrs instead, so the user keeps working and can
+// decide what to do (eg. via "snap connections") rather than losing the
+// connection outright the moment a refresh happens to widen an attribute.
+// Undesired and hotplug-gone connections are left untouched, same as
+// RefreshConnectionsStaticAttrs - there is no fresh policy decision to make
+// for a connection that is not currently active. A policy lookup failure
+// (a missing base declaration or a transient assertstate error, as opposed
+// to the policy itself declining the pair) is tolerated by keeping the
+// stored attributes and leaving the stale marking alone, since it says
+// nothing about whether the connection is actually still allowed.
+//
+// Like RefreshConnectionsStaticAttrs, every snap on either side of a
+// connection whose attrs were actually updated has its security profile
+// regenerated via SetupAffectedSnapsSecurity afterwards; marking a
+// connection stale, unlike updating it, doesn't change what the repository
+// or security backends see, so it doesn't contribute to that set.
+//
+// ReloadConnectionsTxn, not this function, is what ReloadConnections runs
+// (see its doc comment) - it disconnects on policy deny rather than keeping
+// the connection and marking it stale. This is the one "preserve working
+// connections" entry point there is; nothing in this tree calls it outside
+// tests.
+func RefreshConnectionsStaticAttrsPreservingStale(st *state.State, repo *interfaces.Repository, deviceCtx snapstate.DeviceContext) error {
+	conns, err := getConns(st)
+	if err != nil {
+		return fmt.Errorf("cannot obtain connections: %v", err)
+	}
+
+	changed := false
+	affected := make(map[string]bool)
+	for id, cstate := range conns {
+		if cstate.HotplugGone || cstate.Undesired {
+			continue
+		}
+		connRef, err := interfaces.ParseConnRef(id)
+		if err != nil {
+			logger.Noticef("cannot parse connection identifier %q: %v", id, err)
+			continue
+		}
+
+		plugAttrs, slotAttrs, updated, forbidden := updateStaticAttrsForPolicy(st, repo, deviceCtx, connRef, cstate)
+		switch {
+		case forbidden:
+			// updateStaticAttrsForPolicy already logged why the policy no
+			// longer allows this connection; mark it stale instead of the
+			// "undesired" outcome its own message describes, since this
+			// variant keeps the connection working on its old attrs.
+			if err := MarkConnectionStaleAttrs(st, connRef, true); err != nil {
+				return err
+			}
+		case updated:
+			if err := MarkConnectionStaleAttrs(st, connRef, false); err != nil {
+				return err
+			}
+			cstate.StaticPlugAttrs = plugAttrs
+			cstate.StaticSlotAttrs = slotAttrs
+			conns[id] = cstate
+			changed = true
+			affected[connRef.PlugRef.Snap] = true
+			affected[connRef.SlotRef.Snap] = true
+
+			if err := repo.UpdateConnection(connRef, plugAttrs, slotAttrs); err != nil {
+				logger.Noticef("cannot apply refreshed attributes to connection %s: %v", connRef, err)
+			}
+		default:
+			if err := MarkConnectionStaleAttrs(st, connRef, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	if changed {
+		setConns(st, conns)
+		if err := SetupAffectedSnapsSecurity(st, sortedSnapNames(affected)); err != nil {
+			return fmt.Errorf("cannot regenerate security profiles after refreshing connections: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package ifacestate
+
+import (
+	"fmt"
+
+	"github.com/snapcore/snapd/interfaces"
+	"github.com/snapcore/snapd/overlord/snapstate"
+	"github.com/snapcore/snapd/overlord/state"
+)
+
+// reloadConnectionPlan is the decision updateStaticAttrsForPolicy reached
+// for one connection, kept apart from applying it to repo so that planning
+// every connection can finish - and fail - before repo sees a single
+// mutation.
+type reloadConnectionPlan struct {
+	connRef              *interfaces.ConnRef
+	plugAttrs, slotAttrs map[string]interface{}
+	updated, forbidden   bool
+}
+
+// ReloadConnectionsTxn is the transactional entry point for refreshing
+// reloaded connections' static attrs against the current
+// connect/auto-connect policy: it is the only one of this package's several
+// "refresh static attrs" variants that ReloadConnections (see
+// reload_entrypoint.go) runs; nothing in this package calls
+// ReloadConnections itself. The others -
+// RefreshConnectionsStaticAttrs/ForTask, RefreshConnectionsStaticAttrsForSnap,
+// RefreshHotplugSlotStaticAttrs, RefreshConnectionsStaticAttrsPreservingStale
+// - are distinct scopes or policy-deny strategies (a setup-profiles task,
+// a hotplug re-evaluation, a "preserve working connections" policy
+// choice) with no caller in this tree outside tests; ReloadConnections
+// runs none of them.
+//
+// It wraps the same policy re-evaluation those variants share
+// (updateStaticAttrsForPolicy) with the transactional guarantee the reload
+// path needs at manager startup: every connection is planned against a
+// snapshot of conns first, and repo is only mutated - via
+// Disconnect/UpdateConnection - once every connection has planned
+// successfully. If planning any connection fails (eg. its connection id
+// cannot be parsed) the whole pass is aborted before repo is touched at
+// all, and a single error aggregating every failure is returned, instead
+// of leaving repo's in-memory connection graph ahead of the conns this
+// function (deliberately) never got to commit. On success, every affected
+// snap's security profile is regenerated via SetupAffectedSnapsSecurity,
+// the same as the non-transactional reload variants.
+func ReloadConnectionsTxn(st *state.State, repo *interfaces.Repository, deviceCtx snapstate.DeviceContext) error {
+	snapshot, err := getConns(st)
+	if err != nil {
+		return fmt.Errorf("cannot obtain connections: %v", err)
+	}
+
+	var failures []string
+	var plans []reloadConnectionPlan
+	conns := copyConnState(snapshot)
+	for id, cstate := range conns {
+		if cstate.HotplugGone || cstate.Undesired {
+			continue
+		}
+		connRef, err := interfaces.ParseConnRef(id)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", id, err))
+			continue
+		}
+		// Deliberately not applyStaticAttrsRefresh: unlike the other reload
+		// variants, this only plans the change here - repo is not mutated
+		// until every connection has planned without error - so there is no
+		// shared apply step to call into yet.
+		plugAttrs, slotAttrs, updated, forbidden := updateStaticAttrsForPolicy(st, repo, deviceCtx, connRef, cstate)
+		if !updated && !forbidden {
+			continue
+		}
+		plans = append(plans, reloadConnectionPlan{
+			connRef:   connRef,
+			plugAttrs: plugAttrs,
+			slotAttrs: slotAttrs,
+			updated:   updated,
+			forbidden: forbidden,
+		})
+	}
+
+	if len(failures) > 0 {
+		// Nothing above touched repo or conns; there is nothing to undo.
+		return fmt.Errorf("cannot refresh %d connection(s) on reload:\n- %s", len(failures), joinLines(failures))
+	}
+
+	affected := make(map[string]bool)
+	for _, plan := range plans {
+		id := plan.connRef.ID()
+		cstate := conns[id]
+		switch {
+		case plan.forbidden:
+			if err := repo.Disconnect(plan.connRef.PlugRef.Snap, plan.connRef.PlugRef.Name, plan.connRef.SlotRef.Snap, plan.connRef.SlotRef.Name); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", plan.connRef, err))
+				continue
+			}
+			cstate.Undesired = true
+		case plan.updated:
+			if err := repo.UpdateConnection(plan.connRef, plan.plugAttrs, plan.slotAttrs); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", plan.connRef, err))
+				continue
+			}
+			cstate.StaticPlugAttrs = plan.plugAttrs
+			cstate.StaticSlotAttrs = plan.slotAttrs
+		}
+		conns[id] = cstate
+		affected[plan.connRef.PlugRef.Snap] = true
+		affected[plan.connRef.SlotRef.Snap] = true
+	}
+
+	if len(failures) > 0 {
+		// Every plan was sound, so only a live backend error lands here;
+		// repo may already carry some of this pass's mutations with no way
+		// to undo them against an opaque repository, but conns is left
+		// unset so a retry starts from the same snapshot this pass did.
+		return fmt.Errorf("cannot refresh %d connection(s) on reload:\n- %s", len(failures), joinLines(failures))
+	}
+
+	setConns(st, conns)
+	if len(affected) > 0 {
+		if err := SetupAffectedSnapsSecurity(st, sortedSnapNames(affected)); err != nil {
+			return fmt.Errorf("cannot regenerate security profiles after reloading connections: %v", err)
+		}
+	}
+	return nil
+}
+
+func copyConnState(conns map[string]connState) map[string]connState {
+	out := make(map[string]connState, len(conns))
+	for id, cstate := range conns {
+		out[id] = cstate
+	}
+	return out
+}
+
+func joinLines(lines []string) string {
+	out := ""
+	for i, line := range lines {
+		if i > 0 {
+			out += "\n- "
+		}
+		out += line
+	}
+	return out
+}